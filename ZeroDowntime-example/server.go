@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"gopkg.in/kornel661/nserv.v0"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -36,6 +37,7 @@ func main() {
 	// set-up server:
 	srv := &nserv.Server{}
 	srv.Addr = "localhost:12345"
+	srv.Logger = slog.Default()
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Hello, I was launched at %v. Still %d zero-downtime restarts to go.", startTime, *numRestarts)
 	})
@@ -58,7 +60,9 @@ func main() {
 			//     * arg
 			//     * some internal nserv flag that specifies which file descriptor
 			//       to use for srv.ResumeServe()
-			srv.ZeroDowntimeRestart(arg)
+			if err := srv.ZeroDowntimeRestart(arg); err != nil {
+				slog.Error("zero-downtime restart failed", "error", err)
+			}
 		}
 	}()
 
@@ -67,14 +71,13 @@ func main() {
 	if !nserv.CanResume() { // start serving
 		log.Printf("Serving at http://%s\n", srv.Addr)
 		if err := srv.ListenAndServe(); err != nil {
-			log.Println(err)
+			slog.Error("serving failed", "error", err)
 		}
 	} else { // try to resume serving
 		log.Printf("Trying to resume serving at the previous address.\n")
 		err := srv.ResumeAndServe()
 		if err != nil {
-			log.Println("Couldn't resume serving! Buu! (or other error)")
-			log.Println(err)
+			slog.Error("couldn't resume serving", "error", err)
 		}
 	}
 }
@@ -0,0 +1,45 @@
+package nserv
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// acceptRetry accepts a connection from listener l. Temporary failures (e.g.,
+// running out of file descriptors) are retried with exponential back-off (5ms
+// to 1s, as http.Server does), other errors are returned.
+func acceptRetry(l net.Listener) (net.Conn, error) {
+	var delay time.Duration // how long to sleep on accept failure
+	for {
+		c, err := l.Accept()
+		if err == nil || !temporaryAcceptError(err) {
+			return c, err
+		}
+		if delay == 0 {
+			delay = 5 * time.Millisecond
+		} else if delay *= 2; delay > time.Second {
+			delay = time.Second
+		}
+		time.Sleep(delay)
+	}
+}
+
+// temporaryAcceptError tells whether accept error err is worth retrying.
+func temporaryAcceptError(err error) bool {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	switch errno {
+	case syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EINTR,
+		syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,244 @@
+package nserv
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AccessLogFormat is the format of access log entries.
+type AccessLogFormat int
+
+// Supported access log formats.
+const (
+	// AccessLogCommon is the Apache Common Log Format:
+	//	host - user [time] "request" status bytes
+	AccessLogCommon AccessLogFormat = iota
+	// AccessLogCombined is the Apache Combined Log Format:
+	//	host - user [time] "request" status bytes "referer" "user-agent"
+	AccessLogCombined
+	// AccessLogJSON writes one JSON object per line, with all recorded fields
+	// (incl. duration, TLS version and connection ID).
+	AccessLogJSON
+)
+
+// DefaultAccessLogBuffer is the default number of buffered access log entries.
+var DefaultAccessLogBuffer = 1024
+
+// AccessLogFlushTimeout bounds the time AccessLog.Flush and AccessLog.Close
+// wait for the writer, so that a stuck writer doesn't block the server.
+var AccessLogFlushTimeout = 5 * time.Second
+
+// AccessLog writes access log entries of requests served by a Server (see
+// Server.AccessLog). Entries are written asynchronously through a bounded
+// buffer, so that a slow writer doesn't block request handling. If the buffer
+// is full entries are dropped (see Dropped).
+//
+// The remote address is taken from the connection, so it's the client's
+// address behind a proxy if the server parses PROXY protocol headers (see
+// Server.ProxyProtocol).
+type AccessLog struct {
+	Writer     io.Writer       // destination of the log
+	Format     AccessLogFormat // format of the entries
+	BufferSize int             // number of buffered entries (default: DefaultAccessLogBuffer)
+
+	once    sync.Once
+	mu      sync.RWMutex // guards closing entries
+	closed  bool
+	entries chan *accessLogEntry
+	done    chan struct{} // closed when run returns
+	dropped atomic.Uint64
+}
+
+// accessLogEntry describes a served request.
+type accessLogEntry struct {
+	Time       time.Time     `json:"time"`
+	Remote     string        `json:"remote"`
+	User       string        `json:"user,omitempty"`
+	Method     string        `json:"method"`
+	Path       string        `json:"path"`
+	Proto      string        `json:"proto"`
+	Status     int           `json:"status"`
+	Bytes      int64         `json:"bytes"`
+	Duration   float64       `json:"duration"` // in seconds
+	Referer    string        `json:"referer,omitempty"`
+	UserAgent  string        `json:"user_agent,omitempty"`
+	TLSVersion string        `json:"tls_version,omitempty"`
+	ConnID     uint64        `json:"conn_id,omitempty"`
+	flushed    chan struct{} // if not nil, closed when written (flush marker)
+}
+
+// start starts the goroutine writing the entries.
+func (al *AccessLog) start() {
+	al.once.Do(func() {
+		size := al.BufferSize
+		if size <= 0 {
+			size = DefaultAccessLogBuffer
+		}
+		al.entries = make(chan *accessLogEntry, size)
+		al.done = make(chan struct{})
+		go al.run()
+	})
+}
+
+// run writes the entries.
+func (al *AccessLog) run() {
+	defer close(al.done)
+	var buf []byte
+	for e := range al.entries {
+		if e.flushed != nil {
+			close(e.flushed)
+			continue
+		}
+		buf = al.format(buf[:0], e)
+		al.Writer.Write(buf)
+	}
+}
+
+// log queues entry e, drops it if the buffer is full (or the log is closed).
+func (al *AccessLog) log(e *accessLogEntry) {
+	al.start()
+	al.mu.RLock()
+	defer al.mu.RUnlock()
+	if al.closed {
+		al.dropped.Add(1)
+		return
+	}
+	select {
+	case al.entries <- e:
+	default:
+		al.dropped.Add(1)
+	}
+}
+
+// Flush waits until all entries queued so far are written, at most
+// AccessLogFlushTimeout (see FlushContext).
+func (al *AccessLog) Flush() error {
+	ctx, cancel := context.WithTimeout(context.Background(), AccessLogFlushTimeout)
+	defer cancel()
+	return al.FlushContext(ctx)
+}
+
+// FlushContext waits until all entries queued so far are written or ctx is
+// done (returns ctx.Err() then).
+func (al *AccessLog) FlushContext(ctx context.Context) error {
+	al.start()
+	done := make(chan struct{})
+	al.mu.RLock()
+	if al.closed {
+		al.mu.RUnlock()
+		done = al.done
+	} else {
+		select {
+		case al.entries <- &accessLogEntry{flushed: done}:
+			al.mu.RUnlock()
+		case <-ctx.Done():
+			al.mu.RUnlock()
+			return ctx.Err()
+		}
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops the log once the queued entries are written (waits at most
+// AccessLogFlushTimeout, returns context.DeadlineExceeded then). Entries
+// logged afterwards are dropped. The Writer isn't closed.
+func (al *AccessLog) Close() error {
+	al.start()
+	al.mu.Lock()
+	if !al.closed {
+		al.closed = true
+		close(al.entries)
+	}
+	al.mu.Unlock()
+	timer := time.NewTimer(AccessLogFlushTimeout)
+	defer timer.Stop()
+	select {
+	case <-al.done:
+		return nil
+	case <-timer.C:
+		return context.DeadlineExceeded
+	}
+}
+
+// Dropped returns the number of entries dropped because the buffer was full
+// (or the log was closed).
+func (al *AccessLog) Dropped() uint64 {
+	return al.dropped.Load()
+}
+
+// format appends entry e formatted according to al.Format to buf.
+func (al *AccessLog) format(buf []byte, e *accessLogEntry) []byte {
+	if al.Format == AccessLogJSON {
+		b, _ := json.Marshal(e)
+		return append(append(buf, b...), '\n')
+	}
+	host, _, err := net.SplitHostPort(e.Remote)
+	if err != nil {
+		host = e.Remote
+	}
+	buf = append(buf, orDash(host)...)
+	buf = append(buf, " - "...)
+	buf = append(buf, orDash(e.User)...)
+	buf = append(buf, " ["...)
+	buf = e.Time.AppendFormat(buf, "02/Jan/2006:15:04:05 -0700")
+	buf = append(buf, "] "...)
+	buf = strconv.AppendQuote(buf, e.Method+" "+e.Path+" "+e.Proto)
+	buf = append(buf, ' ')
+	buf = strconv.AppendInt(buf, int64(e.Status), 10)
+	buf = append(buf, ' ')
+	if e.Bytes > 0 {
+		buf = strconv.AppendInt(buf, e.Bytes, 10)
+	} else {
+		buf = append(buf, '-')
+	}
+	if al.Format == AccessLogCombined {
+		buf = append(buf, ' ')
+		buf = strconv.AppendQuote(buf, orDash(e.Referer))
+		buf = append(buf, ' ')
+		buf = strconv.AppendQuote(buf, orDash(e.UserAgent))
+	}
+	return append(buf, '\n')
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// newAccessLogEntry returns an access log entry of request r which started at
+// start and was responded to via w.
+func newAccessLogEntry(r *http.Request, w *statusWriter, start time.Time) *accessLogEntry {
+	e := &accessLogEntry{
+		Time:      start,
+		Remote:    r.RemoteAddr,
+		Method:    r.Method,
+		Path:      r.URL.RequestURI(),
+		Proto:     r.Proto,
+		Status:    w.code,
+		Bytes:     w.bytes,
+		Duration:  time.Since(start).Seconds(),
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+	}
+	e.User, _, _ = r.BasicAuth()
+	if r.TLS != nil {
+		e.TLSVersion = tls.VersionName(r.TLS.Version)
+	}
+	e.ConnID, _ = ConnID(r.Context())
+	return e
+}
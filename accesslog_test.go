@@ -0,0 +1,103 @@
+package nserv_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"gopkg.in/kornel661/nserv.v0"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// serveAccessLog serves a single request to path with access log al.
+func serveAccessLog(t *testing.T, al *nserv.AccessLog, path string) {
+	srv := newServer()
+	srv.Handler = http.HandlerFunc(handler)
+	srv.AccessLog = al
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	time.Sleep(delay)
+	getFunc(t, path)
+	srv.Stop()
+	<-finish
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	var buf bytes.Buffer
+	serveAccessLog(t, &nserv.AccessLog{Writer: &buf, Format: nserv.AccessLogJSON}, "/json")
+	var entry struct {
+		Method string
+		Path   string
+		Status int
+		Bytes  int
+		ConnID uint64 `json:"conn_id"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Method != "GET" || entry.Path != "/json" || entry.Status != 200 ||
+		entry.Bytes != len("/json") || entry.ConnID != 1 {
+		t.Errorf("Unexpected entry: %s", buf.String())
+	}
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	var buf bytes.Buffer
+	serveAccessLog(t, &nserv.AccessLog{Writer: &buf, Format: nserv.AccessLogCombined}, "/combined")
+	re := regexp.MustCompile(`^127\.0\.0\.1 - - \[[^]]+\] "GET /combined HTTP/1\.1" 200 9 "-" "Go-http-client/1\.1"\n$`)
+	if !re.Match(buf.Bytes()) {
+		t.Errorf("Unexpected entry: %q", buf.String())
+	}
+}
+
+// stuckWriter blocks writes until closed.
+type stuckWriter chan struct{}
+
+func (w stuckWriter) Write(b []byte) (int, error) {
+	<-w
+	return len(b), nil
+}
+
+// TestAccessLogStuckWriter checks that a stuck writer doesn't block the server.
+func TestAccessLogStuckWriter(t *testing.T) {
+	old := nserv.AccessLogFlushTimeout
+	nserv.AccessLogFlushTimeout = 100 * time.Millisecond
+	defer func() { nserv.AccessLogFlushTimeout = old }()
+	w := make(stuckWriter)
+	defer close(w)
+	al := &nserv.AccessLog{Writer: w, BufferSize: 1}
+	start := time.Now()
+	serveAccessLog(t, al, "/stuck")
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Server blocked by the access log for %v.", d)
+	}
+	if err := al.Flush(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+// TestAccessLogClose checks that entries logged after Close are dropped.
+func TestAccessLogClose(t *testing.T) {
+	var buf bytes.Buffer
+	al := &nserv.AccessLog{Writer: &buf}
+	serveAccessLog(t, al, "/before")
+	if err := al.Close(); err != nil {
+		t.Fatal(err)
+	}
+	n := buf.Len()
+	serveAccessLog(t, al, "/after")
+	if buf.Len() != n || n == 0 || al.Dropped() != 1 {
+		t.Errorf("Unexpected log (%d dropped): %q", al.Dropped(), buf.String())
+	}
+	if err := al.Flush(); err != nil {
+		t.Errorf("Flush of a closed log: %v", err)
+	}
+}
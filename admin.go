@@ -0,0 +1,281 @@
+package nserv
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AdminAuth configures authentication of AdminHandler requests. A request is
+// authorized if it passes any of the configured methods.
+type AdminAuth struct {
+	// Token is the bearer token ("Authorization: Bearer <Token>").
+	Token string
+	// ClientNames are the accepted common names (or DNS names) of verified
+	// client certificates (mTLS). The admin listener has to request and
+	// verify client certificates (see tls.Config.ClientAuth).
+	ClientNames []string
+}
+
+// AdminHandler returns an http.Handler exposing operations of the server srv
+// over HTTP. It's meant to be served on a separate (internal) listener, e.g.,
+// by another Server. Paths are relative to the handler's mount point (use
+// http.StripPrefix to mount it elsewhere):
+//
+//	GET    /status               lifecycle state, limit, paused and maintenance flags
+//	GET    /stats                statistics (see Stats)
+//	GET    /connections          open connections (see Connections)
+//	POST   /maxconns?n=N         set the throttling limit (see MaxConns)
+//	POST   /pause                pause accepting (see Pause)
+//	POST   /resume               resume accepting (see Resume)
+//	POST   /stop                 stop gracefully (see Stop)
+//	POST   /restart?arg=A&arg=B  zero-downtime restart (see ZeroDowntimeRestart)
+//	GET    /maintenance          maintenance mode settings (null if off)
+//	PUT    /maintenance          enter maintenance mode (Maintenance as JSON body)
+//	DELETE /maintenance          leave maintenance mode
+//	POST   /certificates/reload  reload the TLS certificate (see ReloadCertificates)
+//	POST   /tickets/rotate       rotate the TLS session ticket keys (see RotateTicketKeys)
+//	POST   /ocsp/refresh         fetch the OCSP response right away (see RefreshOCSP)
+//	POST   /reload               reload the configuration file (see ReloadConfig)
+//	GET    /ipfilter             IP filter rules with hit counters (see IPFilter.Rules)
+//	POST   /ipfilter/reload      reload the IP filter file (see IPFilter.Reload)
+//	GET    /bans                 banned clients (see Bans)
+//	DELETE /bans?ip=IP           lift the ban of IP, or all the bans without ip (see Unban, ClearBans)
+//
+// Responses are JSON objects (errors as {"error": "..."}). If auth is nil
+// requests aren't authenticated.
+func AdminHandler(srv *Server, auth *AdminAuth) http.Handler {
+	routes := make(map[string]map[string]http.HandlerFunc) // path -> method -> handler
+	handle := func(method, path string, h http.HandlerFunc) {
+		if routes[path] == nil {
+			routes[path] = make(map[string]http.HandlerFunc)
+		}
+		routes[path][method] = h
+	}
+	handle("GET", "/status", func(w http.ResponseWriter, r *http.Request) {
+		s := srv.Stats()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"state":       s.State.String(),
+			"limit":       s.Limit,
+			"paused":      s.Paused,
+			"maintenance": s.Maintenance,
+		})
+	})
+	handle("GET", "/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, adminStats(srv.Stats()))
+	})
+	handle("GET", "/connections", func(w http.ResponseWriter, r *http.Request) {
+		conns := []map[string]interface{}{}
+		for _, c := range srv.Connections() {
+			conns = append(conns, map[string]interface{}{
+				"id":       c.ID,
+				"remote":   c.Remote,
+				"state":    c.State.String(),
+				"age":      c.Age.Seconds(),
+				"in_state": c.InState.Seconds(),
+			})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"connections": conns})
+	})
+	handle("POST", "/maxconns", func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(r.FormValue("n"))
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("invalid limit"))
+			return
+		}
+		free := srv.MaxConns(n)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"limit": n, "free": free})
+	})
+	handle("POST", "/pause", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"changed": srv.Pause()})
+	})
+	handle("POST", "/resume", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"changed": srv.Resume()})
+	})
+	handle("POST", "/stop", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"changed": srv.Stop()})
+	})
+	handle("POST", "/restart", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if err := srv.ZeroDowntimeRestart(r.Form["arg"]...); err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"handoffs": srv.Stats().Handoffs})
+	})
+	handle("GET", "/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, srv.Maintenance())
+	})
+	handle("PUT", "/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		var m Maintenance
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := srv.SetMaintenance(&m); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, srv.Maintenance())
+	})
+	handle("DELETE", "/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		srv.SetMaintenance(nil)
+		writeJSON(w, http.StatusOK, srv.Maintenance())
+	})
+	handle("POST", "/certificates/reload", func(w http.ResponseWriter, r *http.Request) {
+		if err := srv.ReloadCertificates(); err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"reloaded": true})
+	})
+	handle("POST", "/tickets/rotate", func(w http.ResponseWriter, r *http.Request) {
+		if err := srv.RotateTicketKeys(); err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"rotated": true})
+	})
+	handle("POST", "/ocsp/refresh", func(w http.ResponseWriter, r *http.Request) {
+		if err := srv.RefreshOCSP(); err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"refreshed": true})
+	})
+	handle("POST", "/reload", func(w http.ResponseWriter, r *http.Request) {
+		res, err := srv.ReloadConfig()
+		if err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	})
+	handle("GET", "/ipfilter", func(w http.ResponseWriter, r *http.Request) {
+		rules, unmatched := []IPRule{}, uint64(0)
+		if f := srv.IPFilter; f != nil {
+			rules, unmatched = f.Rules(), f.Unmatched()
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"rules": rules, "unmatched": unmatched})
+	})
+	handle("POST", "/ipfilter/reload", func(w http.ResponseWriter, r *http.Request) {
+		err := ErrNoIPFilterFile
+		if f := srv.IPFilter; f != nil {
+			err = f.Reload()
+		}
+		if err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"rules": srv.IPFilter.Rules()})
+	})
+	handle("GET", "/bans", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"bans": srv.Bans()})
+	})
+	handle("DELETE", "/bans", func(w http.ResponseWriter, r *http.Request) {
+		cleared := 0
+		if ip := r.FormValue("ip"); ip == "" {
+			cleared = srv.ClearBans()
+		} else if srv.Unban(ip) {
+			cleared = 1
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"cleared": cleared})
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		methods, ok := routes[r.URL.Path]
+		if !ok {
+			writeError(w, http.StatusNotFound, errors.New("not found"))
+			return
+		}
+		h, ok := methods[r.Method]
+		if !ok {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		h(w, r)
+	})
+}
+
+// authorized tells if request r passes authentication.
+func (a *AdminAuth) authorized(r *http.Request) bool {
+	if a == nil {
+		return true
+	}
+	if a.Token != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1 {
+			return true
+		}
+	}
+	if len(a.ClientNames) > 0 && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		for _, name := range a.ClientNames {
+			if cert.Subject.CommonName == name || cert.VerifyHostname(name) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// adminStats returns statistics s as served by AdminHandler.
+func adminStats(s Stats) map[string]interface{} {
+	return map[string]interface{}{
+		"state":                 s.State.String(),
+		"paused":                s.Paused,
+		"maintenance":           s.Maintenance,
+		"limit":                 s.Limit,
+		"active":                s.Active,
+		"idle":                  s.Idle,
+		"accepted":              s.Accepted,
+		"rejected":              s.Rejected,
+		"queued":                s.Queued,
+		"filtered":              s.Filtered,
+		"banned":                s.Banned,
+		"handshaking":           s.Handshaking,
+		"handshake_failures":    s.HandshakeFailures,
+		"accept_errors":         s.AcceptErrors,
+		"requests":              s.Requests,
+		"maintenance_responses": s.MaintenanceResponses,
+		"slow_headers":          s.SlowHeaders,
+		"slow_uploads":          s.SlowUploads,
+		"slow_downloads":        s.SlowDownloads,
+		"recycled":              s.Recycled,
+		"bytes_in":              s.BytesIn,
+		"bytes_out":             s.BytesOut,
+		"handoffs":              s.Handoffs,
+		"uptime":                s.Uptime.Seconds(),
+	}
+}
+
+// errorStatus returns the HTTP status code corresponding to error err.
+func errorStatus(err error) int {
+	var ce *ConfigError
+	switch {
+	case errors.Is(err, ErrServerNotRunning), errors.Is(err, ErrNoCertificates), errors.Is(err, ErrNoConfigFile), errors.Is(err, ErrNoIPFilterFile),
+		errors.Is(err, ErrNoTicketKeys), errors.Is(err, ErrNoOCSP):
+		return http.StatusConflict
+	case errors.As(err, &ce):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,89 @@
+package nserv_test
+
+import (
+	"context"
+	"encoding/json"
+	"gopkg.in/kornel661/nserv.v0"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// adminRequest sends a request to the admin handler h, decodes the response.
+func adminRequest(t *testing.T, h http.Handler, method, path, body string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var resp map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Errorf("%s %s: %v", method, path, err)
+	}
+	return rec.Code, resp
+}
+
+// TestAdminHandler checks operations exposed by AdminHandler.
+func TestAdminHandler(t *testing.T) {
+	srv := newServer()
+	srv.InitialMaxConns = 5
+	srv.Handler = http.HandlerFunc(handler)
+	admin := nserv.AdminHandler(srv, &nserv.AdminAuth{Token: "secret"})
+
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Unauthenticated request: %d", rec.Code)
+	}
+	if code, resp := adminRequest(t, admin, "POST", "/certificates/reload", ""); code != http.StatusConflict {
+		t.Errorf("Reloading certificates: %d %v", code, resp)
+	}
+
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+		t.Fatal(err)
+	}
+	getFunc(t, "/admin")
+
+	if _, resp := adminRequest(t, admin, "GET", "/status", ""); resp["state"] != "serving" || resp["limit"] != 5.0 {
+		t.Errorf("Status: %v", resp)
+	}
+	if _, resp := adminRequest(t, admin, "GET", "/stats", ""); resp["accepted"] != 1.0 || resp["requests"] != 1.0 {
+		t.Errorf("Stats: %v", resp)
+	}
+	_, resp := adminRequest(t, admin, "GET", "/connections", "")
+	if conns, _ := resp["connections"].([]interface{}); len(conns) != 1 {
+		t.Errorf("Connections: %v", resp)
+	}
+	if code, _ := adminRequest(t, admin, "GET", "/stop", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /stop: %d", code)
+	}
+	if code, _ := adminRequest(t, admin, "POST", "/maxconns?n=x", ""); code != http.StatusBadRequest {
+		t.Errorf("Invalid limit: %d", code)
+	}
+	adminRequest(t, admin, "POST", "/maxconns?n=3", "")
+	if s := srv.Stats(); s.Limit != 3 {
+		t.Errorf("Limit: %d", s.Limit)
+	}
+	adminRequest(t, admin, "PUT", "/maintenance", `{"status_code": 502}`)
+	if m := srv.Maintenance(); m == nil || m.StatusCode != 502 {
+		t.Errorf("Maintenance: %+v", m)
+	}
+	adminRequest(t, admin, "DELETE", "/maintenance", "")
+	if m := srv.Maintenance(); m != nil {
+		t.Errorf("Maintenance: %+v", m)
+	}
+	if _, resp := adminRequest(t, admin, "POST", "/stop", ""); resp["changed"] != true {
+		t.Errorf("Stop: %v", resp)
+	}
+	<-finish
+	if code, _ := adminRequest(t, admin, "POST", "/restart", ""); code != http.StatusConflict {
+		t.Errorf("Restart of a stopped server: %d", code)
+	}
+}
@@ -0,0 +1,383 @@
+package nserv
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Admission configures priority lanes for incoming connections. Every accepted
+// connection is assigned to the first class it matches (or to the general
+// pool if it matches none). Each class can have some of the throttling limit
+// reserved for it, so that e.g. health checks and admin traffic are admitted
+// even if the server is saturated by public traffic.
+//
+// Connections that can't be admitted right away wait in a queue of length
+// Backlog (queued connections don't count towards the limit). Connections
+// arriving when the queue is full are rejected (closed).
+//
+// Classes matching ServerNames need TLS handshakes before classification.
+// ListenAndServeTLS performs them beforehand, for TLS listeners passed to
+// Serve they're performed here, at most Server.MaxHandshakes at a time (no
+// connections are accepted while the limit is reached).
+type Admission struct {
+	Classes          []AdmissionClass // admission classes, first match wins
+	Backlog          int              // max number of queued connections (default: DefaultAdmissionBacklog)
+	HandshakeTimeout time.Duration    // TLS handshake timeout when classifying by SNI (default: DefaultHandshakeTimeout)
+}
+
+// AdmissionClass describes a class of connections and the capacity reserved for
+// it. A connection belongs to the class if it matches any of the Networks,
+// Listeners or ServerNames entries.
+type AdmissionClass struct {
+	Name        string   // name of the class (used in statistics)
+	Networks    []string // source addresses in CIDR notation (or single IPs), e.g., "10.0.0.0/8"
+	Listeners   []string // local addresses the connection was accepted on, e.g., "127.0.0.1:8080" or ":8081"
+	ServerNames []string // TLS server names (SNI), only for TLS listeners
+	Reserved    int      // number of slots reserved for the class
+	Share       float64  // fraction of the limit reserved for the class, e.g., 0.05
+}
+
+// DefaultAdmissionBacklog is the default length of the admission queue.
+var DefaultAdmissionBacklog = 1024
+
+// admissionClass is the parsed version of AdmissionClass.
+type admissionClass struct {
+	AdmissionClass
+	networks []*net.IPNet
+	active   int // number of admitted connections of this class
+	reserved int // how many of the active connections use reserved slots
+}
+
+// admissionListener classifies connections accepted from the underlying
+// listener and admits them according to the capacity reserved for each class.
+// It accepts connections eagerly in the background and queues them, so that
+// connections with reserved capacity never wait behind the general traffic.
+type admissionListener struct {
+	net.Listener
+	classes          []*admissionClass // configured classes, the last one is the general pool
+	backlog          int
+	handshakeTimeout time.Duration
+	needSNI          bool           // whether to perform TLS handshakes before classification
+	handshakes       chan struct{}  // slots of handshakes in progress (see Server.MaxHandshakes)
+	onReject         func(net.Conn) // called when a connection is rejected
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	queue    []*admissionConn // queued (not yet admitted) connections
+	limit    int              // throttling limit
+	general  int              // number of admitted connections not using reserved slots
+	err      error            // accept error to be returned by Accept
+	closed   bool
+	rejected uint64 // number of connections rejected due to full queue
+}
+
+// admissionConn is a connection admitted by the admissionListener.
+type admissionConn struct {
+	net.Conn
+	l        *admissionListener
+	class    *admissionClass
+	reserved bool // uses a reserved slot of its class
+	once     sync.Once
+}
+
+// tlsConn returns the TLS connection c wraps (nil if it isn't one), see
+// tlsMarker.
+func (c *admissionConn) tlsConn() *tls.Conn {
+	tc, _ := c.Conn.(*tls.Conn)
+	return tc
+}
+
+// newAdmissionListener wraps listn with an admissionListener configured by adm,
+// performing at most maxHandshakes TLS handshakes at a time (0:
+// DefaultMaxHandshakes). Function onReject is called for each rejected
+// connection.
+func newAdmissionListener(listn net.Listener, adm *Admission, limit, maxHandshakes int, onReject func(net.Conn)) (*admissionListener, error) {
+	l := &admissionListener{
+		Listener:         listn,
+		backlog:          adm.Backlog,
+		handshakeTimeout: adm.HandshakeTimeout,
+		onReject:         onReject,
+		limit:            limit,
+	}
+	if l.backlog <= 0 {
+		l.backlog = DefaultAdmissionBacklog
+	}
+	if l.handshakeTimeout <= 0 {
+		l.handshakeTimeout = DefaultHandshakeTimeout
+	}
+	if maxHandshakes <= 0 {
+		maxHandshakes = DefaultMaxHandshakes
+	}
+	l.handshakes = make(chan struct{}, maxHandshakes)
+	l.cond = sync.NewCond(&l.mu)
+	for _, c := range adm.Classes {
+		class := &admissionClass{AdmissionClass: c}
+		for _, cidr := range c.Networks {
+			n, err := parseNetwork(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("admission class %q: %v", c.Name, err)
+			}
+			class.networks = append(class.networks, n)
+		}
+		if c.Reserved < 0 || c.Share < 0 || c.Share > 1 {
+			return nil, fmt.Errorf("admission class %q: invalid reservation", c.Name)
+		}
+		if len(c.ServerNames) > 0 {
+			l.needSNI = true
+		}
+		l.classes = append(l.classes, class)
+	}
+	// the general pool
+	l.classes = append(l.classes, &admissionClass{AdmissionClass: AdmissionClass{Name: "general"}})
+	go l.acceptLoop()
+	return l, nil
+}
+
+// parseNetwork parses CIDR notation or a single IP address.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", s)
+		}
+		bits := 8 * len(ip)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// acceptLoop accepts connections from the underlying listener and queues them.
+func (l *admissionListener) acceptLoop() {
+	for {
+		c, err := acceptRetry(l.Listener)
+		if err != nil {
+			l.mu.Lock()
+			l.err = err
+			l.cond.Broadcast()
+			l.mu.Unlock()
+			return
+		}
+		if tc, ok := c.(*tls.Conn); ok && l.needSNI && !tc.ConnectionState().HandshakeComplete {
+			l.handshakes <- struct{}{} // wait for a free slot
+			go func() {
+				l.enqueue(c)
+				<-l.handshakes
+			}()
+		} else {
+			l.enqueue(c)
+		}
+	}
+}
+
+// enqueue classifies connection c and puts it into the queue.
+func (l *admissionListener) enqueue(c net.Conn) {
+	ac := &admissionConn{Conn: c, l: l, class: l.classify(c)}
+	l.mu.Lock()
+	if l.closed || len(l.queue) >= l.backlog {
+		closed := l.closed
+		if !closed {
+			l.rejected++
+		}
+		l.mu.Unlock()
+		if !closed && l.onReject != nil {
+			l.onReject(c)
+		}
+		c.Close()
+		return
+	}
+	l.queue = append(l.queue, ac)
+	l.cond.Broadcast()
+	l.mu.Unlock()
+}
+
+// classify returns the class connection c belongs to.
+func (l *admissionListener) classify(c net.Conn) *admissionClass {
+	var serverName string
+	if tc, ok := c.(*tls.Conn); ok && l.needSNI {
+		ctx, cancel := context.WithTimeout(context.Background(), l.handshakeTimeout)
+		if tc.HandshakeContext(ctx) == nil {
+			serverName = tc.ConnectionState().ServerName
+		}
+		cancel()
+	}
+	var ip net.IP
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	for _, class := range l.classes[:len(l.classes)-1] {
+		if class.matches(ip, c.LocalAddr(), serverName) {
+			return class
+		}
+	}
+	return l.classes[len(l.classes)-1]
+}
+
+// matches tells if a connection from ip accepted on local with the given SNI
+// belongs to the class.
+func (class *admissionClass) matches(ip net.IP, local net.Addr, serverName string) bool {
+	for _, n := range class.networks {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	if local != nil {
+		for _, a := range class.Listeners {
+			if matchAddr(a, local.String()) {
+				return true
+			}
+		}
+	}
+	for _, name := range class.ServerNames {
+		if serverName != "" && strings.EqualFold(name, serverName) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAddr tells if address addr matches pattern (host:port or :port).
+func matchAddr(pattern, addr string) bool {
+	ph, pp, err := net.SplitHostPort(pattern)
+	if err != nil {
+		return false
+	}
+	h, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	return pp == p && (ph == "" || ph == h)
+}
+
+// reservedSlots returns the number of slots reserved for class (l.mu held).
+func (l *admissionListener) reservedSlots(class *admissionClass) int {
+	n := int(math.Ceil(class.Share * float64(l.limit)))
+	if class.Reserved > n {
+		n = class.Reserved
+	}
+	return n
+}
+
+// generalSlots returns the number of slots not reserved for any class (l.mu
+// held).
+func (l *admissionListener) generalSlots() int {
+	n := l.limit
+	for _, class := range l.classes {
+		n -= l.reservedSlots(class)
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n
+}
+
+// admit tries to admit one of the queued connections (l.mu held).
+func (l *admissionListener) admit() *admissionConn {
+	general := l.generalSlots()
+	for i, c := range l.queue {
+		switch {
+		case c.class.reserved < l.reservedSlots(c.class):
+			c.reserved = true
+			c.class.reserved++
+		case l.general < general:
+			l.general++
+		default:
+			continue
+		}
+		c.class.active++
+		l.queue = append(l.queue[:i], l.queue[i+1:]...)
+		return c
+	}
+	return nil
+}
+
+// Accept waits for and returns the next admitted connection.
+func (l *admissionListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for {
+		if l.closed {
+			return nil, net.ErrClosed
+		}
+		if c := l.admit(); c != nil {
+			return c, nil
+		}
+		if l.err != nil {
+			return nil, l.err
+		}
+		l.cond.Wait()
+	}
+}
+
+// Close closes the underlying listener and all queued connections.
+func (l *admissionListener) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	for _, c := range l.queue {
+		c.Conn.Close()
+	}
+	l.queue = nil
+	l.cond.Broadcast()
+	l.mu.Unlock()
+	return l.Listener.Close()
+}
+
+// File returns a copy of the underlying listener's file descriptor (if
+// supported), so that the listener can be handed off.
+func (l *admissionListener) File() (*os.File, error) {
+	return listenerFile(l.Listener)
+}
+
+// listenerFile returns a copy of listener l's file descriptor (if supported).
+func listenerFile(l net.Listener) (*os.File, error) {
+	if fl, ok := l.(interface {
+		File() (*os.File, error)
+	}); ok {
+		return fl.File()
+	}
+	return nil, fmt.Errorf("nserv: listener %T doesn't support File()", l)
+}
+
+// setLimit sets the throttling limit the reservations are computed against.
+func (l *admissionListener) setLimit(n int) {
+	l.mu.Lock()
+	l.limit = n
+	l.cond.Broadcast()
+	l.mu.Unlock()
+}
+
+// Close closes the connection and frees its slot.
+func (c *admissionConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		l := c.l
+		l.mu.Lock()
+		c.class.active--
+		if c.reserved {
+			c.class.reserved--
+		} else {
+			l.general--
+		}
+		l.cond.Broadcast()
+		l.mu.Unlock()
+	})
+	return err
+}
+
+// counts returns the number of queued connections and the total number of
+// rejected connections.
+func (l *admissionListener) counts() (queued int, rejected uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.queue), l.rejected
+}
@@ -0,0 +1,181 @@
+package nserv_test
+
+import (
+	"context"
+	"crypto/tls"
+	"gopkg.in/kornel661/nserv.v0"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestAdmission checks that reserved capacity is available to its class even
+// if the general pool is exhausted.
+func TestAdmission(t *testing.T) {
+	srv := newServer()
+	srv.InitialMaxConns = 2
+	srv.Handler = http.HandlerFunc(handler)
+	srv.Admission = &nserv.Admission{
+		Classes: []nserv.AdmissionClass{
+			{Name: "admin", Networks: []string{"127.0.0.2"}, Reserved: 1},
+		},
+	}
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	time.Sleep(delay)
+
+	// occupy the general pool
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(delay)
+
+	// general traffic is queued
+	client := &http.Client{Timeout: 2 * delay}
+	if resp, err := client.Get("http://" + addr + "/general"); err == nil {
+		resp.Body.Close()
+		t.Error("General connection admitted beyond its share.")
+	}
+
+	// admin traffic gets in
+	admin := &http.Client{
+		Timeout: time.Second,
+		Transport: &http.Transport{
+			Dial: (&net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}}).Dial,
+		},
+	}
+	if resp, err := admin.Get("http://" + addr + "/admin"); err != nil {
+		t.Errorf("Admin connection not admitted: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+
+	idle.Close()
+	srv.Stop()
+	<-finish
+}
+
+// flakyListener fails the first fails calls to Accept with EMFILE (running out
+// of file descriptors).
+type flakyListener struct {
+	net.Listener
+	fails atomic.Int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.fails.Add(-1) >= 0 {
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	}
+	return l.Listener.Accept()
+}
+
+// TestAcceptRetry checks that temporary accept failures beneath the admission
+// layer are retried.
+func TestAcceptRetry(t *testing.T) {
+	srv := newServer()
+	srv.Handler = http.HandlerFunc(handler)
+	srv.InitialMaxConns = 10
+	srv.Admission = &nserv.Admission{}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fl := &flakyListener{Listener: l}
+	fl.fails.Store(3)
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.Serve(fl); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	getFunc(t, "/retried")
+	if s := srv.Stats(); s.AcceptErrors != 0 || s.State != nserv.StateServing {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+	srv.Stop()
+	<-finish
+}
+
+// TestAdmissionSNIHandshakes checks that handshakes performed for
+// classification by SNI are bounded by MaxHandshakes (and that admitted
+// requests get their TLS state).
+func TestAdmissionSNIHandshakes(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer()
+	srv.InitialMaxConns = 10
+	srv.MaxHandshakes = 2
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); !ok || r.TLS == nil || r.TLS.ServerName != "admin.example" {
+			http.Error(w, "no TLS state", http.StatusInternalServerError)
+			return
+		}
+		handler(w, r)
+	})
+	srv.Admission = &nserv.Admission{
+		Classes: []nserv.AdmissionClass{{Name: "admin", ServerNames: []string{"admin.example"}, Reserved: 1}},
+	}
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.Serve(tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}})); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+		t.Fatal(err)
+	}
+	goroutines := runtime.NumGoroutine()
+
+	// clients stuck in the handshake take the slots, the others wait
+	stuck := make([]net.Conn, 50)
+	for i := range stuck {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		stuck[i] = c
+	}
+	time.Sleep(4 * delay)
+	if n := runtime.NumGoroutine() - goroutines; n > 5 {
+		t.Errorf("%d goroutines started for handshakes.", n)
+	}
+	for _, c := range stuck {
+		c.Close()
+	}
+
+	client := &http.Client{Timeout: 2 * time.Second, Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true, ServerName: "admin.example"},
+	}}
+	if resp, err := client.Get("https://" + addr + "/admin"); err != nil {
+		t.Error(err)
+	} else {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Status code %d.", resp.StatusCode)
+		}
+	}
+	client.CloseIdleConnections()
+	srv.Stop()
+	<-finish
+}
@@ -0,0 +1,298 @@
+package nserv
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BanPolicy configures temporary banning of abusive clients, fail2ban-style
+// (see Server.BanPolicy). Events are counted per client IP address over Window;
+// when a count exceeds its threshold, the address is banned: its open
+// connections are closed and new ones are closed right after accepting (before
+// throttling). Every subsequent ban of an address lasts Backoff times longer
+// than the previous one (up to MaxBanTime). Zero threshold disables counting of
+// the corresponding event.
+type BanPolicy struct {
+	MaxRejections        int // connections rejected by admission control (see Admission)
+	MaxHandshakeFailures int // failed (or abandoned) TLS handshakes
+	MaxSlowClients       int // connections closed by SlowClientPolicy
+	MaxClientErrors      int // responses with 4xx status codes
+
+	Window     time.Duration // events are counted over Window (default: DefaultBanWindow)
+	BanTime    time.Duration // duration of the first ban (default: DefaultBanTime)
+	MaxBanTime time.Duration // maximum duration of a ban (default: DefaultMaxBanTime)
+	Backoff    float64       // ban time multiplier for repeat offenders (default: 2)
+	// Forget is the time after the end of the last ban after which the
+	// address's offenses are forgotten (default: DefaultBanForget).
+	Forget time.Duration
+}
+
+// Defaults of BanPolicy.
+var (
+	DefaultBanWindow  = time.Minute
+	DefaultBanTime    = 10 * time.Minute
+	DefaultMaxBanTime = 24 * time.Hour
+	DefaultBanForget  = 24 * time.Hour
+)
+
+// Ban describes a banned client, see Server.Bans.
+type Ban struct {
+	IP       string    `json:"ip"`
+	Until    time.Time `json:"until"`    // the ban expires at Until
+	Offenses int       `json:"offenses"` // number of bans of the address (incl. this one)
+	Reason   string    `json:"reason"`   // event which triggered the ban
+}
+
+// banEvent is a kind of event counted by BanPolicy.
+type banEvent int
+
+const (
+	banRejected banEvent = iota
+	banHandshake
+	banSlow
+	banClientError
+	banEvents // number of event kinds
+)
+
+// banReasons are the reasons of bans (by banEvent).
+var banReasons = [banEvents]string{"rejections", "handshake_failures", "slow_client", "client_errors"}
+
+// threshold returns the threshold of event e.
+func (p *BanPolicy) threshold(e banEvent) int {
+	return [banEvents]int{p.MaxRejections, p.MaxHandshakeFailures, p.MaxSlowClients, p.MaxClientErrors}[e]
+}
+
+// withDefaults returns a copy of p with zero settings replaced by the defaults.
+func (p *BanPolicy) withDefaults() *BanPolicy {
+	c := *p
+	if c.Window <= 0 {
+		c.Window = DefaultBanWindow
+	}
+	if c.BanTime <= 0 {
+		c.BanTime = DefaultBanTime
+	}
+	if c.MaxBanTime <= 0 {
+		c.MaxBanTime = DefaultMaxBanTime
+	}
+	if c.Backoff < 1 {
+		c.Backoff = 2
+	}
+	if c.Forget <= 0 {
+		c.Forget = DefaultBanForget
+	}
+	return &c
+}
+
+// banList holds the state of banning.
+type banList struct {
+	policy  atomic.Pointer[BanPolicy] // policy in force (with defaults, nil if off)
+	mu      sync.Mutex
+	clients map[string]*banClient // by IP address
+}
+
+// banClient holds the record of a client.
+type banClient struct {
+	counts   [banEvents]int       // numbers of events in the current windows
+	windows  [banEvents]time.Time // starts of the current windows
+	until    time.Time            // end of the (last) ban
+	offenses int
+	reason   string
+}
+
+// banned tells if address ip is banned.
+func (b *banList) banned(ip net.IP) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.clients[ip.String()]
+	return ok && time.Now().Before(c.until)
+}
+
+// record records event e of address ip, returns the ban if the address got
+// banned by it.
+func (b *banList) record(ip net.IP, e banEvent) *Ban {
+	p := b.policy.Load()
+	if p == nil || p.threshold(e) <= 0 {
+		return nil
+	}
+	now := time.Now()
+	key := ip.String()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.clients[key]
+	if !ok {
+		if b.clients == nil {
+			b.clients = make(map[string]*banClient)
+		}
+		c = &banClient{}
+		b.clients[key] = c
+	}
+	if now.Before(c.until) {
+		return nil // banned already (event of a connection in flight)
+	}
+	if now.Sub(c.windows[e]) > p.Window {
+		c.windows[e], c.counts[e] = now, 0
+	}
+	c.counts[e]++
+	if c.counts[e] <= p.threshold(e) {
+		return nil
+	}
+	if !c.until.IsZero() && now.Sub(c.until) > p.Forget {
+		c.offenses = 0
+	}
+	d := float64(p.BanTime)
+	for i := 0; i < c.offenses && d < float64(p.MaxBanTime); i++ {
+		d *= p.Backoff
+	}
+	if d > float64(p.MaxBanTime) {
+		d = float64(p.MaxBanTime)
+	}
+	c.offenses++
+	c.until, c.reason = now.Add(time.Duration(d)), banReasons[e]
+	c.counts, c.windows = [banEvents]int{}, [banEvents]time.Time{}
+	return &Ban{IP: key, Until: c.until, Offenses: c.offenses, Reason: c.reason}
+}
+
+// prune forgets clients without any recent activity.
+func (b *banList) prune(now time.Time) {
+	p := b.policy.Load()
+	if p == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, c := range b.clients {
+		if now.Sub(c.until) <= p.Forget {
+			continue
+		}
+		recent := false
+		for _, w := range c.windows {
+			recent = recent || now.Sub(w) <= p.Window
+		}
+		if !recent {
+			delete(b.clients, key)
+		}
+	}
+}
+
+// restore adds bans (passed on by the predecessor in a zero-downtime restart).
+func (b *banList) restore(bans []Ban) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ban := range bans {
+		if b.clients == nil {
+			b.clients = make(map[string]*banClient)
+		}
+		b.clients[ban.IP] = &banClient{until: ban.Until, offenses: ban.Offenses, reason: ban.Reason}
+	}
+}
+
+// Bans returns the active bans (see BanPolicy) sorted by IP address.
+func (srv *Server) Bans() []Ban {
+	now := time.Now()
+	b := &srv.bans
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bans := []Ban{}
+	for key, c := range b.clients {
+		if now.Before(c.until) {
+			bans = append(bans, Ban{IP: key, Until: c.until, Offenses: c.offenses, Reason: c.reason})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].IP < bans[j].IP })
+	return bans
+}
+
+// Unban lifts the ban of address ip and forgets its offenses. Returns false if
+// the address isn't banned.
+func (srv *Server) Unban(ip string) bool {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		ip = parsed.String()
+	}
+	b := &srv.bans
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.clients[ip]
+	delete(b.clients, ip)
+	return ok && time.Now().Before(c.until)
+}
+
+// ClearBans lifts all the bans and forgets all offenses. Returns the number of
+// lifted bans.
+func (srv *Server) ClearBans() int {
+	now := time.Now()
+	b := &srv.bans
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, c := range b.clients {
+		if now.Before(c.until) {
+			n++
+		}
+	}
+	b.clients = nil
+	return n
+}
+
+// allowedAddr tells if connections from addr aren't banned.
+func (b *banList) allowedAddr(addr net.Addr) bool {
+	ip := addrIP(addr)
+	return ip == nil || !b.banned(ip)
+}
+
+// banEvent records event e of a client at addr, bans the client if a
+// threshold is exceeded.
+func (srv *Server) banEvent(addr net.Addr, e banEvent) {
+	if ip := addrIP(addr); ip != nil {
+		srv.banIP(ip, e)
+	}
+}
+
+// banRequest records the response to request r (answered with status code).
+func (srv *Server) banRequest(r *http.Request, code int) {
+	if code >= 400 && code < 500 {
+		if ip := hostIP(r.RemoteAddr); ip != nil {
+			srv.banIP(ip, banClientError)
+		}
+	}
+}
+
+// banIP records event e of address ip, closes connections of ip if it's got
+// banned.
+func (srv *Server) banIP(ip net.IP, e banEvent) {
+	ban := srv.bans.record(ip, e)
+	if ban == nil {
+		return
+	}
+	var conns []net.Conn
+	t := &srv.stats.conns
+	t.mu.Lock()
+	for c := range t.conns {
+		if cip := addrIP(c.RemoteAddr()); cip != nil && cip.Equal(ip) {
+			conns = append(conns, c)
+		}
+	}
+	t.mu.Unlock()
+	srv.logger().Warn("client banned", LogKeyRemote, ban.IP, LogKeyReason, ban.Reason,
+		LogKeyUntil, ban.Until, LogKeyAffected, len(conns))
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// pruneBans forgets inactive clients every window until done is closed.
+func (srv *Server) pruneBans(window time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			srv.bans.prune(now)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package nserv_test
+
+import (
+	"context"
+	"encoding/json"
+	"gopkg.in/kornel661/nserv.v0"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestBans checks that clients exceeding a threshold get banned, with
+// exponential back-off.
+func TestBans(t *testing.T) {
+	srv := newServer()
+	srv.BanPolicy = &nserv.BanPolicy{
+		MaxClientErrors: 2,
+		BanTime:         300 * time.Millisecond,
+		MaxBanTime:      time.Hour,
+	}
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		handler(w, r)
+	})
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+		t.Fatal(err)
+	}
+	misbehave := func() {
+		for i := 0; i < 3; i++ {
+			if resp, err := http.Get("http://" + addr + "/missing"); err == nil {
+				resp.Body.Close()
+			}
+		}
+		http.DefaultClient.CloseIdleConnections()
+	}
+
+	misbehave()
+	banned := srv.Stats().Banned // the last request might have been retried
+	bans := srv.Bans()
+	if len(bans) != 1 || bans[0].Offenses != 1 || bans[0].Reason != "client_errors" {
+		t.Fatalf("Unexpected bans: %+v", bans)
+	}
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !closedWithin(c, time.Second) {
+		t.Error("Connection of a banned client not closed.")
+	}
+	c.Close()
+	if s := srv.Stats(); s.Banned != banned+1 {
+		t.Errorf("Banned %d connections, expected %d.", s.Banned, banned+1)
+	}
+
+	// the second ban lasts longer
+	time.Sleep(time.Until(bans[0].Until))
+	getFunc(t, "/unbanned")
+	misbehave()
+	bans = srv.Bans()
+	if len(bans) != 1 || bans[0].Offenses != 2 || time.Until(bans[0].Until) < 400*time.Millisecond {
+		t.Fatalf("Unexpected bans: %+v", bans)
+	}
+	if !srv.Unban(bans[0].IP) || srv.Unban(bans[0].IP) {
+		t.Error("Unban should succeed exactly once.")
+	}
+	getFunc(t, "/unbanned")
+	if len(srv.Bans()) != 0 || srv.ClearBans() != 0 {
+		t.Error("Bans not lifted.")
+	}
+	srv.Stop()
+	<-finish
+}
+
+// TestBansHandoff checks that bans are passed on in a zero-downtime restart,
+// even too many of them to fit in an environment variable.
+func TestBansHandoff(t *testing.T) {
+	var bans []nserv.Ban
+	until := time.Now().Add(time.Hour).Round(0)
+	for i := 0; i < 5000; i++ {
+		ip := net.IPv4(10, 0, byte(i>>8), byte(i)).String()
+		bans = append(bans, nserv.Ban{IP: ip, Until: until, Offenses: 1, Reason: "client_errors"})
+	}
+	srv := newServer()
+	srv.Handler = http.HandlerFunc(handler)
+	nserv.AddBans(srv, bans)
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+		t.Fatal(err)
+	}
+	handOff(t, srv, finish, "http")
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	defer stopSuccessor(t, client, "http")
+
+	resp, err := client.Get("http://" + addr + "/state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var state successorState
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Handoff {
+		t.Errorf("%s left in the environment.", nserv.HandoffEnv)
+	}
+	got, want := state.Bans, srv.Bans()
+	if len(got) != len(want) {
+		t.Fatalf("Passed on %d bans, expected %d.", len(got), len(want))
+	}
+	for i := range got {
+		if got[i].IP != want[i].IP || !got[i].Until.Equal(want[i].Until) || got[i].Reason != want[i].Reason {
+			t.Fatalf("Unexpected ban %+v, expected %+v.", got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package nserv
+
+import (
+	"crypto/tls"
+	"sync/atomic"
+	"time"
+)
+
+// certificate is the server's certificate loaded from files.
+type certificate struct {
+	certFile, keyFile string
+	cert              *tls.Certificate
+	staple            atomic.Pointer[ocspStaple] // OCSP response (nil if none), see OCSPPolicy
+}
+
+// ocspStaple is a certificate with an OCSP response stapled.
+type ocspStaple struct {
+	cert       *tls.Certificate // copy of the certificate with OCSPStaple set
+	nextUpdate time.Time        // the response expires at nextUpdate (if not zero)
+}
+
+// served returns the certificate to be served, with the OCSP response stapled
+// if there's a valid one.
+func (c *certificate) served() *tls.Certificate {
+	if s := c.staple.Load(); s != nil && (s.nextUpdate.IsZero() || time.Now().Before(s.nextUpdate)) {
+		return s.cert
+	}
+	return c.cert
+}
+
+// setCertificate makes c the server's current certificate.
+func (srv *Server) setCertificate(c *certificate) {
+	srv.certificate.Store(c)
+	srv.ocsp.kick() // fetch the OCSP response for the new certificate
+}
+
+// loadCertificate loads the certificate from certFile and keyFile and makes it
+// the server's current certificate.
+func (srv *Server) loadCertificate(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	srv.setCertificate(&certificate{certFile: certFile, keyFile: keyFile, cert: &cert})
+	return nil
+}
+
+// ReloadCertificates reloads the certificate and key from the files passed to
+// ListenAndServeTLS. New TLS handshakes use the reloaded certificate,
+// established connections aren't affected. If loading fails the current
+// certificate is kept. Returns ErrNoCertificates if the server hasn't been
+// started with ListenAndServeTLS.
+func (srv *Server) ReloadCertificates() error {
+	c := srv.certificate.Load()
+	if c == nil {
+		return ErrNoCertificates
+	}
+	if err := srv.loadCertificate(c.certFile, c.keyFile); err != nil {
+		srv.logger().Error("can't reload certificates", LogKeyError, err)
+		return err
+	}
+	srv.logger().Info("certificates reloaded")
+	return nil
+}
+
+// getCertificate returns the server's current certificate, unless next (the
+// user's tls.Config.GetCertificate, if any) returns one.
+func (srv *Server) getCertificate(next func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if next != nil {
+			if cert, err := next(hello); cert != nil || err != nil {
+				return cert, err
+			}
+		}
+		return srv.certificate.Load().served(), nil
+	}
+}
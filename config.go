@@ -0,0 +1,522 @@
+package nserv
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is a declarative configuration of a Server, see NewServerFromConfig.
+// It can be loaded from a file (see LoadConfig) and environment variables (see
+// Config.LoadEnv). Zero values stand for the defaults.
+type Config struct {
+	Addr        string            `json:"addr,omitempty"`        // TCP address to listen on
+	Label       string            `json:"label,omitempty"`       // see Server.Label
+	Expvar      string            `json:"expvar,omitempty"`      // see Server.Expvar
+	KeepAlives  *bool             `json:"keep_alives,omitempty"` // whether HTTP keep-alives are enabled (default: true)
+	TLS         TLSConfig         `json:"tls"`
+	Timeouts    TimeoutsConfig    `json:"timeouts"`
+	Limits      LimitsConfig      `json:"limits"`
+	Drain       DrainConfig       `json:"drain"`
+	Handoff     HandoffConfig     `json:"handoff"`
+	AccessLog   AccessLogConfig   `json:"access_log"`
+	Maintenance MaintenanceConfig `json:"maintenance"`
+
+	path      string // file the configuration has been loaded from
+	envPrefix string // prefix of the environment variables applied
+}
+
+// TLSConfig configures TLS (the server uses TLS if the files are set).
+type TLSConfig struct {
+	CertFile string `json:"cert_file,omitempty"` // certificate (chain) file
+	KeyFile  string `json:"key_file,omitempty"`  // private key file
+}
+
+// TimeoutsConfig configures timeouts of http.Server.
+type TimeoutsConfig struct {
+	Read       Duration `json:"read,omitempty"`        // see http.Server.ReadTimeout
+	ReadHeader Duration `json:"read_header,omitempty"` // see http.Server.ReadHeaderTimeout
+	Write      Duration `json:"write,omitempty"`       // see http.Server.WriteTimeout
+	Idle       Duration `json:"idle,omitempty"`        // see http.Server.IdleTimeout
+}
+
+// LimitsConfig configures limits of the server.
+type LimitsConfig struct {
+	MaxConns       int `json:"max_conns,omitempty"`        // see Server.InitialMaxConns
+	MaxHeaderBytes int `json:"max_header_bytes,omitempty"` // see http.Server.MaxHeaderBytes
+}
+
+// DrainConfig configures the drain policy, see DrainPolicy.
+type DrainConfig struct {
+	SoftTimeout    Duration `json:"soft_timeout,omitempty"`
+	HardTimeout    Duration `json:"hard_timeout,omitempty"`
+	ActiveDeadline Duration `json:"active_deadline,omitempty"`
+	KillTimeout    Duration `json:"kill_timeout,omitempty"`
+}
+
+// policy returns the drain policy (nil if not configured).
+func (d *DrainConfig) policy() *DrainPolicy {
+	if *d == (DrainConfig{}) {
+		return nil
+	}
+	return &DrainPolicy{
+		SoftTimeout:    time.Duration(d.SoftTimeout),
+		HardTimeout:    time.Duration(d.HardTimeout),
+		ActiveDeadline: time.Duration(d.ActiveDeadline),
+		KillTimeout:    time.Duration(d.KillTimeout),
+	}
+}
+
+// HandoffConfig configures zero-downtime restarts.
+type HandoffConfig struct {
+	Resume bool     `json:"resume,omitempty"` // Run resumes serving an inherited listener if possible
+	Args   []string `json:"args,omitempty"`   // default arguments of the successor (see ZeroDowntimeRestart)
+}
+
+// AccessLogConfig configures the access log, see AccessLog.
+type AccessLogConfig struct {
+	File       string `json:"file,omitempty"`        // log file ("-" for standard output), disabled if empty
+	Format     string `json:"format,omitempty"`      // common (default), combined or json
+	BufferSize int    `json:"buffer_size,omitempty"` // see AccessLog.BufferSize
+}
+
+// MaintenanceConfig configures maintenance mode, see Maintenance.
+type MaintenanceConfig struct {
+	Enabled       bool     `json:"enabled,omitempty"` // whether the server is in maintenance mode
+	StatusCode    int      `json:"status_code,omitempty"`
+	ContentType   string   `json:"content_type,omitempty"`
+	Body          string   `json:"body,omitempty"`
+	RetryAfter    Duration `json:"retry_after,omitempty"`
+	AllowPaths    []string `json:"allow_paths,omitempty"`
+	AllowNetworks []string `json:"allow_networks,omitempty"`
+}
+
+// maintenance returns the maintenance mode settings (nil if disabled).
+func (c *MaintenanceConfig) maintenance() *Maintenance {
+	if !c.Enabled {
+		return nil
+	}
+	return &Maintenance{
+		StatusCode:    c.StatusCode,
+		ContentType:   c.ContentType,
+		Body:          c.Body,
+		RetryAfter:    time.Duration(c.RetryAfter),
+		AllowPaths:    c.AllowPaths,
+		AllowNetworks: c.AllowNetworks,
+	}
+}
+
+// Duration is a time.Duration represented as a string (e.g., "1m30s") in
+// configuration files.
+type Duration time.Duration
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// ConfigError is a configuration error, Field is the offending field (named
+// as in configuration files, e.g., "tls.cert_file").
+type ConfigError struct {
+	Field string
+	Err   error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("nserv: config field %s: %v", e.Field, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// LoadConfig loads configuration from file path. Files with the .json
+// extension are parsed as JSON, other files in a TOML-like format:
+//
+//	# comment
+//	addr = "localhost:8080"
+//	keep_alives = true
+//
+//	[timeouts]
+//	read = "30s"
+//
+//	[handoff]
+//	args = ["-v", "-n=1"]
+//
+// Keys are the same in both formats (see the json tags of Config).
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err = dec.Decode(&m)
+	} else {
+		m, err = parseTOML(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("nserv: %s: %v", path, err)
+	}
+	c := &Config{path: path}
+	if err := decodeConfig(m, reflect.ValueOf(c).Elem(), ""); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// decodeConfig sets fields of struct v (at field path path) from the values in
+// m, returns *ConfigError naming the offending field.
+func decodeConfig(m map[string]interface{}, v reflect.Value, path string) error {
+	fields := make(map[string]reflect.Value)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).IsExported() {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			fields[name] = v.Field(i)
+		}
+	}
+	for key, value := range m {
+		fieldPath := key
+		if path != "" {
+			fieldPath = path + "." + key
+		}
+		field, ok := fields[key]
+		if !ok {
+			return &ConfigError{fieldPath, errors.New("unknown field")}
+		}
+		if field.Kind() == reflect.Struct {
+			sub, ok := value.(map[string]interface{})
+			if !ok {
+				return &ConfigError{fieldPath, errors.New("expected a section")}
+			}
+			if err := decodeConfig(sub, field, fieldPath); err != nil {
+				return err
+			}
+			continue
+		}
+		js, _ := json.Marshal(value)
+		if err := json.Unmarshal(js, field.Addr().Interface()); err != nil {
+			return &ConfigError{fieldPath, fmt.Errorf("invalid value %s", js)}
+		}
+	}
+	return nil
+}
+
+// parseTOML parses the TOML-like configuration data.
+func parseTOML(data []byte) (map[string]interface{}, error) {
+	root := make(map[string]interface{})
+	section := root
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = root
+			for _, name := range strings.Split(line[1:len(line)-1], ".") {
+				name = strings.TrimSpace(name)
+				sub, ok := section[name].(map[string]interface{})
+				if !ok {
+					sub = make(map[string]interface{})
+					section[name] = sub
+				}
+				section = sub
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", i+1)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		var v interface{}
+		switch {
+		case strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") && len(value) >= 2:
+			v = value[1 : len(value)-1]
+		case value == "true", value == "false", strings.HasPrefix(value, `"`), strings.HasPrefix(value, "["):
+			if err := json.Unmarshal([]byte(value), &v); err != nil {
+				return nil, fmt.Errorf("line %d: invalid value of %s: %v", i+1, key, err)
+			}
+		default:
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				return nil, fmt.Errorf("line %d: invalid value of %s: %s", i+1, key, value)
+			}
+			v = json.Number(value)
+		}
+		section[key] = v
+	}
+	return root, nil
+}
+
+// stripComment removes the comment (starting with # outside of quotes) from
+// line.
+func stripComment(line string) string {
+	var quote byte
+	escaped := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// LoadEnv overrides the configuration with environment variables. Variable
+// names consist of prefix and the upper-case field path joined by underscores,
+// e.g., NSERV_ADDR or NSERV_TIMEOUTS_READ for prefix "NSERV". Lists are
+// comma-separated.
+func (c *Config) LoadEnv(prefix string) error {
+	if err := loadEnv(reflect.ValueOf(c).Elem(), prefix, ""); err != nil {
+		return err
+	}
+	c.envPrefix = prefix
+	return c.Validate()
+}
+
+// loadEnv sets fields of struct v from environment variables named prefix_KEY
+// (path is the field path of v).
+func loadEnv(v reflect.Value, prefix, path string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if !t.Field(i).IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		field, fieldPath := v.Field(i), name
+		if path != "" {
+			fieldPath = path + "." + name
+		}
+		env := prefix + "_" + strings.ToUpper(strings.ReplaceAll(fieldPath, ".", "_"))
+		if field.Kind() == reflect.Struct {
+			if err := loadEnv(field, prefix, fieldPath); err != nil {
+				return err
+			}
+			continue
+		}
+		s, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+		var js []byte
+		switch field.Interface().(type) {
+		case string, Duration:
+			js, _ = json.Marshal(s)
+		case []string:
+			list := []string{}
+			for _, item := range strings.Split(s, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			js, _ = json.Marshal(list)
+		default:
+			js = []byte(s)
+		}
+		if err := json.Unmarshal(js, field.Addr().Interface()); err != nil {
+			return &ConfigError{Field: fieldPath, Err: fmt.Errorf("invalid value of %s: %q", env, s)}
+		}
+	}
+	return nil
+}
+
+// Validate checks the configuration, returns *ConfigError naming the first
+// offending field.
+func (c *Config) Validate() error {
+	if c.Addr != "" {
+		if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+			return &ConfigError{"addr", err}
+		}
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		if c.TLS.CertFile == "" {
+			return &ConfigError{"tls.cert_file", errors.New("missing (key_file is set)")}
+		}
+		return &ConfigError{"tls.key_file", errors.New("missing (cert_file is set)")}
+	}
+	for _, d := range []struct {
+		field string
+		value Duration
+	}{
+		{"timeouts.read", c.Timeouts.Read},
+		{"timeouts.read_header", c.Timeouts.ReadHeader},
+		{"timeouts.write", c.Timeouts.Write},
+		{"timeouts.idle", c.Timeouts.Idle},
+		{"drain.soft_timeout", c.Drain.SoftTimeout},
+		{"drain.hard_timeout", c.Drain.HardTimeout},
+		{"drain.active_deadline", c.Drain.ActiveDeadline},
+		{"drain.kill_timeout", c.Drain.KillTimeout},
+		{"maintenance.retry_after", c.Maintenance.RetryAfter},
+	} {
+		if d.value < 0 {
+			return &ConfigError{d.field, errors.New("negative duration")}
+		}
+	}
+	if c.Limits.MaxConns < 0 {
+		return &ConfigError{"limits.max_conns", errors.New("negative limit")}
+	}
+	if c.Limits.MaxHeaderBytes < 0 {
+		return &ConfigError{"limits.max_header_bytes", errors.New("negative limit")}
+	}
+	if _, err := parseAccessLogFormat(c.AccessLog.Format); err != nil {
+		return &ConfigError{"access_log.format", err}
+	}
+	if c.AccessLog.BufferSize < 0 {
+		return &ConfigError{"access_log.buffer_size", errors.New("negative size")}
+	}
+	if code := c.Maintenance.StatusCode; code != 0 && (code < 100 || code > 999) {
+		return &ConfigError{"maintenance.status_code", fmt.Errorf("invalid status code %d", code)}
+	}
+	for _, n := range c.Maintenance.AllowNetworks {
+		if _, err := parseNetwork(n); err != nil {
+			return &ConfigError{"maintenance.allow_networks", err}
+		}
+	}
+	return nil
+}
+
+// parseAccessLogFormat parses the name of an access log format.
+func parseAccessLogFormat(s string) (AccessLogFormat, error) {
+	switch strings.ToLower(s) {
+	case "", "common":
+		return AccessLogCommon, nil
+	case "combined":
+		return AccessLogCombined, nil
+	case "json":
+		return AccessLogJSON, nil
+	}
+	return 0, fmt.Errorf("unknown format %q", s)
+}
+
+// NewServerFromConfig returns a Server configured according to c (the defaults
+// are captured as by NewServer), ready to be started with Run. The TLS certificate and the access log file are opened
+// right away.
+func NewServerFromConfig(c *Config) (*Server, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	opts := []Option{WithAddr(c.Addr), WithLabel(c.Label)}
+	if c.Timeouts.Read != 0 {
+		opts = append(opts, WithReadTimeout(time.Duration(c.Timeouts.Read)))
+	}
+	if c.Timeouts.ReadHeader != 0 {
+		opts = append(opts, WithReadHeaderTimeout(time.Duration(c.Timeouts.ReadHeader)))
+	}
+	if c.Timeouts.Write != 0 {
+		opts = append(opts, WithWriteTimeout(time.Duration(c.Timeouts.Write)))
+	}
+	if c.Timeouts.Idle != 0 {
+		opts = append(opts, WithIdleTimeout(time.Duration(c.Timeouts.Idle)))
+	}
+	if c.Limits.MaxHeaderBytes != 0 {
+		opts = append(opts, WithMaxHeaderBytes(c.Limits.MaxHeaderBytes))
+	}
+	if c.Limits.MaxConns != 0 {
+		opts = append(opts, WithMaxConns(c.Limits.MaxConns))
+	}
+	srv := NewServer(opts...)
+	srv.Expvar = c.Expvar
+	if c.KeepAlives != nil && !*c.KeepAlives {
+		srv.SetKeepAlivesEnabled(false)
+	}
+	srv.DrainPolicy = c.Drain.policy()
+	if c.TLS.CertFile != "" {
+		if err := srv.loadCertificate(c.TLS.CertFile, c.TLS.KeyFile); err != nil {
+			return nil, &ConfigError{"tls.cert_file", err}
+		}
+	}
+	if c.AccessLog.File != "" {
+		al, err := newAccessLogFromConfig(&c.AccessLog)
+		if err != nil {
+			return nil, &ConfigError{"access_log.file", err}
+		}
+		srv.AccessLog = al
+	}
+	srv.SetMaintenance(c.Maintenance.maintenance()) // validated already
+	srv.config = c.clone()
+	return srv, nil
+}
+
+// clone returns a deep copy of c.
+func (c *Config) clone() *Config {
+	cfg := *c
+	if c.KeepAlives != nil {
+		keepAlives := *c.KeepAlives
+		cfg.KeepAlives = &keepAlives
+	}
+	cfg.Handoff.Args = append([]string(nil), c.Handoff.Args...)
+	cfg.Maintenance.AllowPaths = append([]string(nil), c.Maintenance.AllowPaths...)
+	cfg.Maintenance.AllowNetworks = append([]string(nil), c.Maintenance.AllowNetworks...)
+	return &cfg
+}
+
+// newAccessLogFromConfig returns the access log configured by c.
+func newAccessLogFromConfig(c *AccessLogConfig) (*AccessLog, error) {
+	format, _ := parseAccessLogFormat(c.Format)
+	w := os.Stdout
+	if c.File != "-" {
+		f, err := os.OpenFile(c.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return &AccessLog{Writer: w, Format: format, BufferSize: c.BufferSize}, nil
+}
+
+// Run starts the server configured by NewServerFromConfig: it resumes serving
+// an inherited listener if Config.Handoff.Resume is set and it's possible (see
+// CanResume), otherwise it listens on srv.Addr (using TLS if the certificate is
+// configured). Servers not created from a Config just ListenAndServe.
+func (srv *Server) Run() error {
+	c := srv.currentConfig()
+	if c == nil {
+		return srv.ListenAndServe()
+	}
+	resume := c.Handoff.Resume && CanResume()
+	switch {
+	case resume && c.TLS.CertFile != "":
+		return srv.ResumeAndServeTLS("", "")
+	case resume:
+		return srv.ResumeAndServe()
+	case c.TLS.CertFile != "":
+		return srv.ListenAndServeTLS("", "")
+	default:
+		return srv.ListenAndServe()
+	}
+}
@@ -0,0 +1,118 @@
+package nserv_test
+
+import (
+	"context"
+	"errors"
+	"gopkg.in/kornel661/nserv.v0"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+# test configuration
+addr = "` + addr + `"
+label = 'test # server'  # comment
+
+[timeouts]
+read = "30s"
+idle = "2m"
+
+[limits]
+max_conns = 7
+
+[drain]
+kill_timeout = "10s"
+
+[handoff]
+args = ["-v", "-n=1"]
+`
+
+// writeConfig writes configuration data to a file named name, returns its path.
+func writeConfig(t *testing.T, name, data string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestLoadConfig checks loading configuration from files and the environment.
+func TestLoadConfig(t *testing.T) {
+	c, err := nserv.LoadConfig(writeConfig(t, "nserv.conf", testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Addr != addr || c.Label != "test # server" || c.Limits.MaxConns != 7 {
+		t.Errorf("Unexpected config: %+v", c)
+	}
+	if time.Duration(c.Timeouts.Read) != 30*time.Second || time.Duration(c.Drain.KillTimeout) != 10*time.Second {
+		t.Errorf("Unexpected timeouts: %+v %+v", c.Timeouts, c.Drain)
+	}
+	if len(c.Handoff.Args) != 2 || c.Handoff.Args[1] != "-n=1" {
+		t.Errorf("Unexpected args: %q", c.Handoff.Args)
+	}
+
+	t.Setenv("NSERV_LIMITS_MAX_CONNS", "3")
+	t.Setenv("NSERV_TIMEOUTS_WRITE", "5s")
+	t.Setenv("NSERV_HANDOFF_ARGS", "-a, -b")
+	if err := c.LoadEnv("NSERV"); err != nil {
+		t.Fatal(err)
+	}
+	if c.Limits.MaxConns != 3 || time.Duration(c.Timeouts.Write) != 5*time.Second || len(c.Handoff.Args) != 2 {
+		t.Errorf("Environment not applied: %+v", c)
+	}
+	t.Setenv("NSERV_KEEP_ALIVES", "maybe")
+	var ce *nserv.ConfigError
+	if err := c.LoadEnv("NSERV"); !errors.As(err, &ce) || ce.Field != "keep_alives" {
+		t.Errorf("Invalid environment: %v", err)
+	}
+
+	for data, field := range map[string]string{
+		`{"timeouts": {"read": "soon"}}`:      "timeouts.read",
+		`{"limits": {"max_conns": -1}}`:       "limits.max_conns",
+		`{"tls": {"cert_file": "x.crt"}}`:     "tls.key_file",
+		`{"access_log": {"format": "fancy"}}`: "access_log.format",
+		`{"addr": "localhost"}`:               "addr",
+		`{"drain": {"bogus": 1}}`:             "drain.bogus",
+	} {
+		_, err := nserv.LoadConfig(writeConfig(t, "nserv.json", data))
+		if !errors.As(err, &ce) || ce.Field != field {
+			t.Errorf("%s: got %v, expected error in %s", data, err, field)
+		}
+	}
+}
+
+// TestNewServerFromConfig checks a server created from configuration.
+func TestNewServerFromConfig(t *testing.T) {
+	c, err := nserv.LoadConfig(writeConfig(t, "nserv.conf", testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := nserv.NewServerFromConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.Addr != addr || srv.IdleTimeout != 2*time.Minute || srv.DrainPolicy == nil || srv.DrainPolicy.KillTimeout != 10*time.Second {
+		t.Errorf("Unexpected server: %+v", srv)
+	}
+	srv.Handler = http.HandlerFunc(handler)
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.Run(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+		t.Fatal(err)
+	}
+	getFunc(t, "/config")
+	if s := srv.Stats(); s.Limit != 7 || s.Requests != 1 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+	srv.Stop()
+	<-finish
+}
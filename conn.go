@@ -0,0 +1,113 @@
+package nserv
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// connKey is the context key of the connection a request arrived on.
+type connKey struct{}
+
+// ConnID returns the ID of the connection the request with context ctx arrived
+// on. Connections are numbered consecutively (starting with 1) in order of
+// acceptance.
+func ConnID(ctx context.Context) (id uint64, ok bool) {
+	if c, ok := ctx.Value(connKey{}).(*statsConn); ok {
+		return c.id, true
+	}
+	return 0, false
+}
+
+// connFromContext returns the connection stored in ctx by the server.
+func connFromContext(ctx context.Context) *statsConn {
+	c, _ := ctx.Value(connKey{}).(*statsConn)
+	return c
+}
+
+// tlsAddr is the local address of a connection marked by tlsMarker. The
+// throttled listener's connections only expose the methods of net.Conn, so the
+// TLS connection beneath is carried through them in the address, up to
+// statsListener.
+type tlsAddr struct {
+	net.Addr
+	conn *tls.Conn
+}
+
+// tlsMarker marks the TLS connections accepted from the underlying listener
+// (see tlsAddr). Wrappers of TLS connections beneath it expose them by a
+// tlsConn method.
+type tlsMarker struct {
+	net.Listener
+}
+
+func (l *tlsMarker) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	var tc *tls.Conn
+	switch conn := c.(type) {
+	case *tls.Conn:
+		tc = conn
+	case interface{ tlsConn() *tls.Conn }:
+		tc = conn.tlsConn()
+	}
+	if tc == nil {
+		return c, nil
+	}
+	return &markedConn{Conn: c, local: &tlsAddr{Addr: c.LocalAddr(), conn: tc}}, nil
+}
+
+// File returns a copy of the underlying listener's file descriptor (for
+// zero-downtime restarts).
+func (l *tlsMarker) File() (*os.File, error) {
+	return listenerFile(l.Listener)
+}
+
+// markedConn is a TLS connection marked by tlsMarker.
+type markedConn struct {
+	net.Conn
+	local *tlsAddr
+}
+
+func (c *markedConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// ConnInfo describes an open connection of a Server, see Server.Connections.
+type ConnInfo struct {
+	ID      uint64         `json:"id"`       // connection ID, see ConnID
+	Remote  string         `json:"remote"`   // client's address
+	State   http.ConnState `json:"state"`    // state of the connection
+	Age     time.Duration  `json:"age"`      // time since the connection was accepted
+	InState time.Duration  `json:"in_state"` // time since the last state change
+}
+
+// Connections returns the server's open connections ordered by ID. It never
+// blocks on the server's state.
+func (srv *Server) Connections() []ConnInfo {
+	t := &srv.stats.conns
+	now := time.Now()
+	t.mu.Lock()
+	conns := make([]ConnInfo, 0, len(t.conns))
+	for c, ci := range t.conns {
+		info := ConnInfo{
+			Remote:  c.RemoteAddr().String(),
+			State:   ci.state,
+			Age:     now.Sub(ci.created),
+			InState: now.Sub(ci.changed),
+		}
+		if sc, ok := c.(*statsConn); ok {
+			info.ID = sc.id
+		}
+		conns = append(conns, info)
+	}
+	t.mu.Unlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	return conns
+}
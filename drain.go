@@ -0,0 +1,153 @@
+package nserv
+
+import (
+	"gopkg.in/kornel661/limitnet.v0"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DrainProgressInterval is the interval of drain progress reports, see
+// Server.Draining.
+var DrainProgressInterval = time.Second
+
+// DrainProgress describes progress of a graceful exit (draining of the
+// remaining connections).
+type DrainProgress struct {
+	Remaining int           // number of remaining connections
+	New       int           // number of remaining connections in http.StateNew
+	Active    int           // number of remaining connections in http.StateActive
+	Idle      int           // number of remaining connections in http.StateIdle
+	OldestAge time.Duration // age of the oldest remaining connection
+	Elapsed   time.Duration // time since draining started
+	Estimate  time.Duration // estimated time left (based on the drain rate so far), -1 if unknown
+	Phase     DrainPhase    // current phase, see DrainPolicy
+}
+
+// Draining returns a channel delivering drain progress reports of the server
+// (every DrainProgressInterval, starting when the server is stopped). The
+// channel is closed when all connections are closed (the last report has
+// Remaining == 0). Only the latest report is kept if the receiver is slow.
+//
+// The channel is closed right away if the server has already been drained.
+func (srv *Server) Draining() <-chan DrainProgress {
+	return srv.drain.subscribe()
+}
+
+// drainReporter delivers drain progress reports to the subscribers.
+type drainReporter struct {
+	mu      sync.Mutex
+	subs    []chan DrainProgress
+	drained bool // reports have been finished
+}
+
+// subscribe returns a new channel delivering drain progress reports.
+func (d *drainReporter) subscribe() <-chan DrainProgress {
+	ch := make(chan DrainProgress, 1)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.drained {
+		close(ch)
+	} else {
+		d.subs = append(d.subs, ch)
+	}
+	return ch
+}
+
+// reset makes the reporter accept subscribers again.
+func (d *drainReporter) reset() {
+	d.mu.Lock()
+	d.drained = false
+	d.mu.Unlock()
+}
+
+// publish sends report p to the subscribers (replacing stale reports), closes
+// the channels if last.
+func (d *drainReporter) publish(p DrainProgress, last bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, ch := range d.subs {
+		select {
+		case <-ch: // drop the stale report
+		default:
+		}
+		ch <- p
+		if last {
+			close(ch)
+		}
+	}
+	if last {
+		d.subs = nil
+		d.drained = true
+	}
+}
+
+// drainConns waits for connections accepted by listener l (and TLS handshakes
+// in progress) to terminate.
+// Meanwhile, drain progress is reported every DrainProgressInterval (see
+// Draining and Hooks.OnDrainProgress) and srv.DrainPolicy is enforced.
+func (srv *Server) drainConns(l limitnet.ThrottledListener) {
+	done := make(chan struct{})
+	reported := make(chan struct{})
+	go func() {
+		srv.reportDrainProgress(done)
+		close(reported)
+	}()
+	go srv.enforceDrainPolicy(done)
+	l.Wait()
+	if hl := srv.stats.handshakes.Load(); hl != nil {
+		hl.wait()
+	}
+	close(done)
+	<-reported
+}
+
+// reportDrainProgress reports drain progress until done is closed.
+func (srv *Server) reportDrainProgress(done <-chan struct{}) {
+	start := time.Now()
+	initial := srv.stats.conns.open()
+	ticker := time.NewTicker(DrainProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			p := DrainProgress{Elapsed: time.Since(start)}
+			p.Phase = DrainPhase(srv.drainState.phase.Load())
+			srv.hooks().OnDrainProgress(p)
+			srv.drain.publish(p, true)
+			return
+		case <-ticker.C:
+			p := srv.stats.conns.progress(start, initial)
+			p.Phase = DrainPhase(srv.drainState.phase.Load())
+			srv.hooks().OnDrainProgress(p)
+			srv.drain.publish(p, false)
+		}
+	}
+}
+
+// progress returns drain progress given the drain started at start with
+// initial connections.
+func (t *connTracker) progress(start time.Time, initial int) DrainProgress {
+	now := time.Now()
+	p := DrainProgress{Elapsed: now.Sub(start), Estimate: -1}
+	t.mu.Lock()
+	for _, ci := range t.conns {
+		switch ci.state {
+		case http.StateNew:
+			p.New++
+		case http.StateIdle:
+			p.Idle++
+		default:
+			p.Active++
+		}
+		if age := now.Sub(ci.created); age > p.OldestAge {
+			p.OldestAge = age
+		}
+	}
+	t.mu.Unlock()
+	p.Remaining = p.New + p.Active + p.Idle
+	if closed := initial - p.Remaining; closed > 0 && p.Elapsed > 0 {
+		p.Estimate = time.Duration(float64(p.Remaining) / float64(closed) * float64(p.Elapsed))
+	}
+	return p
+}
@@ -0,0 +1,47 @@
+package nserv_test
+
+import (
+	"gopkg.in/kornel661/nserv.v0"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestDraining checks drain progress reports.
+func TestDraining(t *testing.T) {
+	defer func(d time.Duration) { nserv.DrainProgressInterval = d }(nserv.DrainProgressInterval)
+	nserv.DrainProgressInterval = delay
+	srv := newServer()
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	time.Sleep(delay)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(delay)
+	progress := srv.Draining()
+	srv.Stop()
+	p, ok := <-progress
+	if !ok {
+		t.Fatal("Channel closed before draining finished.")
+	}
+	if p.Remaining != 1 || p.New != 1 || p.OldestAge < delay {
+		t.Errorf("Unexpected progress: %+v", p)
+	}
+	conn.Close()
+	for p = range progress {
+	}
+	if p.Remaining != 0 {
+		t.Errorf("Unexpected last report: %+v", p)
+	}
+	<-finish
+	if _, ok := <-srv.Draining(); ok {
+		t.Error("Channel open after draining finished.")
+	}
+}
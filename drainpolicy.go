@@ -0,0 +1,154 @@
+package nserv
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// DrainPolicy bounds the duration of a graceful exit (see Server.DrainPolicy).
+// The timeouts are measured from the moment the server is stopped; zero
+// timeout disables the corresponding phase.
+type DrainPolicy struct {
+	// SoftTimeout is the time after which idle connections (incl. new ones
+	// that haven't sent a request yet or finished the TLS handshake) are
+	// closed.
+	SoftTimeout time.Duration
+	// HardTimeout is the time after which deadlines are set on active
+	// connections, so that the responses in flight have ActiveDeadline to
+	// finish.
+	HardTimeout time.Duration
+	// ActiveDeadline is the deadline set on active connections in the hard
+	// phase (default: 1s).
+	ActiveDeadline time.Duration
+	// KillTimeout is the time after which all remaining connections (incl.
+	// hijacked ones) are closed. Serve returns *DrainError in that case.
+	KillTimeout time.Duration
+}
+
+// DrainPhase is a phase of a graceful exit.
+type DrainPhase int32
+
+// Phases of a graceful exit.
+const (
+	DrainGraceful DrainPhase = iota // waiting for connections to finish
+	DrainSoft                       // idle connections closed
+	DrainHard                       // deadlines set on active connections
+	DrainKill                       // all connections closed
+)
+
+var drainPhaseNames = [...]string{
+	DrainGraceful: "graceful",
+	DrainSoft:     "soft",
+	DrainHard:     "hard",
+	DrainKill:     "kill",
+}
+
+func (p DrainPhase) String() string {
+	if p >= 0 && int(p) < len(drainPhaseNames) {
+		return drainPhaseNames[p]
+	}
+	return "unknown"
+}
+
+// DrainError is returned by Serve if connections had to be closed forcibly
+// because of DrainPolicy.KillTimeout.
+type DrainError struct {
+	Cut int // number of connections closed forcibly
+}
+
+func (e *DrainError) Error() string {
+	return fmt.Sprintf("nserv: drain timeout, %d connections cut", e.Cut)
+}
+
+// defaultActiveDeadline is the default DrainPolicy.ActiveDeadline.
+const defaultActiveDeadline = time.Second
+
+// drainState holds the state of the drain policy enforcement.
+type drainState struct {
+	phase atomic.Int32 // current DrainPhase
+	cut   atomic.Int64 // number of connections closed in the kill phase
+}
+
+// enforceDrainPolicy escalates the graceful exit according to srv.DrainPolicy
+// until done is closed.
+func (srv *Server) enforceDrainPolicy(done <-chan struct{}) {
+	srv.drainState.phase.Store(int32(DrainGraceful))
+	srv.drainState.cut.Store(0)
+	srv.mu.Lock() // DrainPolicy can be changed by Reload
+	policy := srv.DrainPolicy
+	srv.mu.Unlock()
+	if policy == nil {
+		return
+	}
+	phases := []struct {
+		phase   DrainPhase
+		timeout time.Duration
+	}{
+		{DrainSoft, policy.SoftTimeout},
+		{DrainHard, policy.HardTimeout},
+		{DrainKill, policy.KillTimeout},
+	}
+	start := time.Now()
+	for _, ph := range phases {
+		if ph.timeout <= 0 {
+			continue
+		}
+		timer := time.NewTimer(ph.timeout - time.Since(start))
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		srv.drainState.phase.Store(int32(ph.phase))
+		n := srv.enterDrainPhase(ph.phase, policy)
+		srv.hooks().OnDrainPhase(ph.phase, n)
+	}
+}
+
+// enterDrainPhase applies phase to the remaining connections, returns the number
+// of affected connections.
+func (srv *Server) enterDrainPhase(phase DrainPhase, policy *DrainPolicy) (n int) {
+	t := &srv.stats.conns
+	deadline := policy.ActiveDeadline
+	if deadline <= 0 {
+		deadline = defaultActiveDeadline
+	}
+	var closing []net.Conn // closed after t.mu is released (see statsConn.Close)
+	t.mu.Lock()
+	for c, ci := range t.conns {
+		switch phase {
+		case DrainSoft:
+			if ci.state == http.StateIdle || ci.state == http.StateNew {
+				closing = append(closing, c)
+				n++
+			}
+		case DrainHard:
+			if ci.state == http.StateActive {
+				c.SetDeadline(time.Now().Add(deadline))
+				n++
+			}
+		case DrainKill:
+			closing = append(closing, c)
+			n++
+		}
+	}
+	if phase == DrainKill {
+		for c := range t.hijacked { // their handlers are on their own
+			closing = append(closing, c)
+			n++
+		}
+		srv.drainState.cut.Store(int64(n))
+	}
+	t.mu.Unlock()
+	for _, c := range closing {
+		c.Close()
+	}
+	if hl := srv.stats.handshakes.Load(); hl != nil && (phase == DrainSoft || phase == DrainKill) {
+		n += hl.abort() // no handlers to wait for
+	}
+	return n
+}
@@ -0,0 +1,101 @@
+package nserv_test
+
+import (
+	"errors"
+	"gopkg.in/kornel661/nserv.v0"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestDrainPolicy checks escalation of graceful exit.
+func TestDrainPolicy(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	srv := newServer()
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release // never finishes on its own
+	})
+	srv.DrainPolicy = &nserv.DrainPolicy{SoftTimeout: delay, KillTimeout: 3 * delay}
+	finish := make(chan error)
+	go func() {
+		finish <- srv.ListenAndServe()
+	}()
+	time.Sleep(delay)
+	// an active connection
+	go func() {
+		if resp, err := http.Get("http://" + addr + "/"); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	// a new (idle) connection
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	time.Sleep(delay)
+	srv.Stop()
+
+	// the idle connection is closed in the soft phase
+	idle.SetReadDeadline(time.Now().Add(2 * delay))
+	if _, err := idle.Read(make([]byte, 1)); err == nil || os.IsTimeout(err) {
+		t.Errorf("Idle connection not closed: %v", err)
+	}
+	// the active one in the kill phase
+	select {
+	case err := <-finish:
+		var de *nserv.DrainError
+		if !errors.As(err, &de) || de.Cut != 1 {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	case <-time.After(10 * delay):
+		t.Fatal("Server hasn't stopped.")
+	}
+}
+
+// TestDrainPolicyHijacked checks that hijacked connections are closed in the
+// kill phase too.
+func TestDrainPolicyHijacked(t *testing.T) {
+	hijacked := make(chan struct{})
+	srv := newServer()
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		close(hijacked)
+		c.Read(make([]byte, 1)) // holds the connection until closed
+	})
+	srv.DrainPolicy = &nserv.DrainPolicy{KillTimeout: 2 * delay}
+	finish := make(chan error)
+	go func() {
+		finish <- srv.ListenAndServe()
+	}()
+	time.Sleep(delay)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	<-hijacked
+	srv.Stop()
+	select {
+	case err := <-finish:
+		var de *nserv.DrainError
+		if !errors.As(err, &de) || de.Cut != 1 {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	case <-time.After(10 * delay):
+		t.Fatal("Server hasn't stopped.")
+	}
+	if !closedWithin(c, time.Second) {
+		t.Error("Hijacked connection not closed.")
+	}
+}
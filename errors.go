@@ -0,0 +1,40 @@
+package nserv
+
+import (
+	"errors"
+)
+
+// Errors returned by the package. Use errors.Is to test for them, the returned
+// errors might wrap these (e.g., with the cause of a failed handoff).
+var (
+	// ErrServerStopped is returned by Serve (and the ListenAndServe family)
+	// if the server has already been stopped.
+	ErrServerStopped = errors.New("nserv: server stopped")
+	// ErrServerRunning is returned by Serve (and the ListenAndServe family)
+	// if the server is already serving.
+	ErrServerRunning = errors.New("nserv: server already running")
+	// ErrServerNotRunning is returned by operations requiring a running
+	// server (OperateOnListener, CopyListenerFD, ZeroDowntimeRestart).
+	ErrServerNotRunning = errors.New("nserv: server not running")
+	// ErrHandoffFailed is returned by ZeroDowntimeRestart if the successor
+	// process couldn't be started (the server keeps serving in that case).
+	ErrHandoffFailed = errors.New("nserv: handoff failed")
+	// ErrListenerCountMismatch is returned by ResumeAndServe if the number of
+	// inherited listeners isn't 1.
+	ErrListenerCountMismatch = errors.New("nserv: unexpected number of inherited listeners")
+	// ErrNoCertificates is returned by ReloadCertificates if the server
+	// hasn't been started with ListenAndServeTLS.
+	ErrNoCertificates = errors.New("nserv: no certificate files to reload")
+	// ErrNoConfigFile is returned by ReloadConfig if the server's
+	// configuration hasn't been loaded from a file.
+	ErrNoConfigFile = errors.New("nserv: configuration not loaded from a file")
+	// ErrNoIPFilterFile is returned by IPFilter.Reload if the filter hasn't
+	// been loaded from a file.
+	ErrNoIPFilterFile = errors.New("nserv: IP filter not loaded from a file")
+	// ErrNoTicketKeys is returned by RotateTicketKeys if the server doesn't
+	// serve TLS with session ticket keys managed by the server.
+	ErrNoTicketKeys = errors.New("nserv: session ticket keys not managed")
+	// ErrNoOCSP is returned by RefreshOCSP if OCSP stapling isn't configured
+	// (see Server.OCSP).
+	ErrNoOCSP = errors.New("nserv: OCSP stapling not configured")
+)
@@ -0,0 +1,26 @@
+package nserv_test
+
+import (
+	"errors"
+	"gopkg.in/kornel661/nserv.v0"
+	"testing"
+)
+
+// TestErrors checks errors returned by a stopped server.
+func TestErrors(t *testing.T) {
+	srv := newServer()
+	go srv.Stop()
+	if err := srv.ListenAndServe(); err != nil {
+		t.Errorf("Graceful stop returned %v.", err)
+	}
+	if err := srv.ListenAndServe(); !errors.Is(err, nserv.ErrServerStopped) {
+		t.Errorf("Serving a stopped server returned %v.", err)
+	}
+	if _, err := srv.CopyListenerFD(); !errors.Is(err, nserv.ErrServerNotRunning) {
+		t.Errorf("CopyListenerFD of a stopped server returned %v.", err)
+	}
+	err := srv.ZeroDowntimeRestart()
+	if !errors.Is(err, nserv.ErrHandoffFailed) || !errors.Is(err, nserv.ErrServerNotRunning) {
+		t.Errorf("ZeroDowntimeRestart of a stopped server returned %v.", err)
+	}
+}
@@ -0,0 +1,6 @@
+package nserv
+
+// AddBans adds bans to the server's ban list (as if restored).
+func AddBans(srv *Server, bans []Ban) {
+	srv.bans.restore(bans)
+}
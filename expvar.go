@@ -0,0 +1,40 @@
+package nserv
+
+import (
+	"expvar"
+	"sync"
+)
+
+// expvarMu guards creation of the expvar maps.
+var expvarMu sync.Mutex
+
+// publishExpvar publishes live statistics of the server in the expvar map named
+// srv.Expvar (created if necessary) under the key srv.Label (or srv.Addr).
+func (srv *Server) publishExpvar() {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+	m, ok := expvar.Get(srv.Expvar).(*expvar.Map)
+	if !ok {
+		if expvar.Get(srv.Expvar) != nil {
+			return // name taken by a variable of a different type
+		}
+		m = expvar.NewMap(srv.Expvar)
+	}
+	m.Set(srv.label(), expvar.Func(srv.expvarStats))
+}
+
+// expvarStats returns statistics of the server published via expvar.
+func (srv *Server) expvarStats() interface{} {
+	s := srv.Stats()
+	return map[string]interface{}{
+		"active":   s.Active,
+		"idle":     s.Idle,
+		"limit":    s.Limit,
+		"free":     s.Limit - s.Active - s.Idle,
+		"accepted": s.Accepted,
+		"rejected": s.Rejected,
+		"queued":   s.Queued,
+		"requests": s.Requests,
+		"state":    s.State.String(),
+	}
+}
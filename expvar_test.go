@@ -0,0 +1,49 @@
+package nserv_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestExpvar checks that statistics are published via expvar.
+func TestExpvar(t *testing.T) {
+	srv := newServer()
+	srv.InitialMaxConns = 3
+	srv.Label = "test"
+	srv.Expvar = "nserv"
+	srv.Handler = http.HandlerFunc(handler)
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	time.Sleep(delay)
+	getFunc(t, "/expvar")
+
+	m, ok := expvar.Get("nserv").(*expvar.Map)
+	if !ok {
+		t.Fatal("Expvar map not published.")
+	}
+	v := m.Get("test")
+	if v == nil {
+		t.Fatal("Server not published.")
+	}
+	var stats struct {
+		Limit    int
+		Accepted int
+		State    string
+	}
+	if err := json.Unmarshal([]byte(v.String()), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Limit != 3 || stats.Accepted != 1 || stats.State != "serving" {
+		t.Errorf("Unexpected stats: %s", v)
+	}
+	srv.Stop()
+	<-finish
+}
@@ -0,0 +1,191 @@
+package nserv
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Defaults of the TLS handshake phase, see Server.HandshakeTimeout and
+// Server.MaxHandshakes.
+var (
+	DefaultHandshakeTimeout = 10 * time.Second
+	DefaultMaxHandshakes    = 128
+)
+
+// Reasons of TLS handshake failures (see Stats.HandshakeFailures).
+const (
+	handshakeTimedOut = iota // the handshake didn't finish in time
+	handshakeClosed          // the client closed (or reset) the connection
+	handshakeNotTLS          // the client doesn't speak TLS (e.g., plain HTTP)
+	handshakeAlert           // the client sent an alert (e.g., rejected the certificate)
+	handshakeProtocol        // the handshake failed otherwise (e.g., no common cipher suite)
+	handshakeReasons         // number of reasons
+)
+
+// handshakeReasonNames are the names of the reasons of handshake failures.
+var handshakeReasonNames = [handshakeReasons]string{"timeout", "closed", "not_tls", "alert", "protocol"}
+
+// handshakeFailure returns the reason of handshake failure err.
+func handshakeFailure(err error) int {
+	var ne net.Error
+	var rhe tls.RecordHeaderError
+	var oe *net.OpError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return handshakeTimedOut
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNRESET):
+		return handshakeClosed
+	case errors.As(err, &rhe):
+		return handshakeNotTLS
+	case errors.As(err, &oe) && oe.Op == "remote error": // alert received (crypto/tls doesn't export its type)
+		return handshakeAlert
+	default:
+		return handshakeProtocol
+	}
+}
+
+// handshakeListener performs TLS handshakes of connections accepted from the
+// underlying listener before passing them on, so that connections which don't
+// finish the handshake (in time) never reach the throttled listener. At most
+// cap(slots) connections are in the handshake phase at a time (including the
+// handshaken ones waiting to be accepted), the underlying listener isn't
+// accepted from while all slots are taken.
+//
+// Handshakes in progress when the listener is closed are let finish (the
+// connections are closed then, as there's no one to serve them), unless
+// aborted, see wait and abort.
+type handshakeListener struct {
+	net.Listener
+	srv       *Server
+	config    *tls.Config
+	timeout   time.Duration
+	slots     chan struct{}
+	ready     chan net.Conn // handshaken connections
+	ctx       context.Context
+	cancel    context.CancelFunc // aborts handshakes in progress
+	closed    chan struct{}      // closed by Close
+	closeOnce sync.Once
+	done      chan struct{}  // closed when acceptLoop returns
+	err       error          // accept error (set before done is closed)
+	wg        sync.WaitGroup // handshakes in progress
+}
+
+// newHandshakeListener wraps listn with a handshakeListener using config and
+// the server's handshake settings.
+func newHandshakeListener(listn net.Listener, srv *Server, config *tls.Config) *handshakeListener {
+	l := &handshakeListener{
+		Listener: listn,
+		srv:      srv,
+		config:   config,
+		timeout:  srv.HandshakeTimeout,
+		ready:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if l.timeout <= 0 {
+		l.timeout = DefaultHandshakeTimeout
+	}
+	max := srv.MaxHandshakes
+	if max <= 0 {
+		max = DefaultMaxHandshakes
+	}
+	l.slots = make(chan struct{}, max)
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	go l.acceptLoop()
+	return l
+}
+
+// acceptLoop accepts connections from the underlying listener (whenever there
+// is a free slot) and starts their handshakes.
+func (l *handshakeListener) acceptLoop() {
+	defer close(l.done)
+	for {
+		select {
+		case l.slots <- struct{}{}:
+		case <-l.closed:
+			l.err = net.ErrClosed
+			return
+		}
+		c, err := acceptRetry(l.Listener)
+		if err != nil {
+			<-l.slots
+			l.err = err
+			return
+		}
+		l.srv.stats.handshaking.Add(1)
+		l.wg.Add(1)
+		go l.handshake(c)
+	}
+}
+
+// handshake performs the handshake of connection c and passes it on.
+func (l *handshakeListener) handshake(c net.Conn) {
+	defer func() {
+		<-l.slots
+		l.wg.Done()
+	}()
+	tc := tls.Server(c, l.config)
+	ctx, cancel := context.WithTimeout(l.ctx, l.timeout)
+	err := tc.HandshakeContext(ctx)
+	cancel()
+	l.srv.stats.handshaking.Add(-1)
+	if err != nil {
+		if l.ctx.Err() == nil { // not aborted
+			reason := handshakeFailure(err)
+			l.srv.stats.handshakeFailures[reason].Add(1)
+			l.srv.logger().Debug("TLS handshake failed", LogKeyRemote, c.RemoteAddr().String(),
+				LogKeyReason, handshakeReasonNames[reason], LogKeyError, err)
+			l.srv.banEvent(c.RemoteAddr(), banHandshake)
+		}
+		c.Close()
+		return
+	}
+	select {
+	case l.ready <- tc:
+	case <-l.closed:
+		tc.Close()
+	}
+}
+
+// Accept waits for and returns the next handshaken connection.
+func (l *handshakeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.ready:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// Close closes the underlying listener.
+func (l *handshakeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// wait waits (after Close) until the handshakes in progress finish.
+func (l *handshakeListener) wait() {
+	<-l.done
+	l.wg.Wait()
+}
+
+// abort aborts the handshakes in progress, returns their number.
+func (l *handshakeListener) abort() int {
+	l.cancel()
+	return int(l.srv.stats.handshaking.Load())
+}
+
+// File returns a copy of the underlying listener's file descriptor (for
+// zero-downtime restarts).
+func (l *handshakeListener) File() (*os.File, error) {
+	return listenerFile(l.Listener)
+}
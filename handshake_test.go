@@ -0,0 +1,150 @@
+package nserv_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"gopkg.in/kornel661/nserv.v0"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for localhost (and its key)
+// to a temporary directory, returns the file names.
+func writeTestCert(t *testing.T) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// TestHandshakes checks the TLS handshake phase: timeout, concurrency limit and
+// failure statistics by reason (and that requests get their TLS state).
+func TestHandshakes(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	srv := newServer()
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || !r.TLS.HandshakeComplete {
+			http.Error(w, "no TLS state", http.StatusInternalServerError)
+			return
+		}
+		handler(w, r)
+	})
+	srv.HandshakeTimeout = 500 * time.Millisecond
+	srv.MaxHandshakes = 1
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServeTLS(certFile, keyFile); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	get := func(path string) error {
+		resp, err := client.Get("https://" + addr + path)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if body, err := ioutil.ReadAll(resp.Body); err != nil || string(body) != path {
+			return fmt.Errorf("got `%s` (%v)", body, err)
+		}
+		return nil
+	}
+	if err := get("/tls"); err != nil {
+		t.Error(err)
+	}
+	client.CloseIdleConnections()
+
+	// a client stuck in the handshake takes the only slot
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for srv.Stats().Handshaking != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	start := time.Now()
+	if err := get("/waiting"); err != nil {
+		t.Error(err)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Errorf("Handshake not delayed by the stuck one (%v).", d)
+	}
+	if !closedWithin(c, time.Second) {
+		t.Error("Stuck handshake not timed out.")
+	}
+	c.Close()
+	client.CloseIdleConnections()
+
+	// plain HTTP to the TLS port
+	c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(c, "GET / HTTP/1.0\r\n\r\n")
+	closedWithin(c, time.Second)
+	c.Close()
+
+	// a verifying client rejects the self-signed certificate (with an alert)
+	if tc, err := tls.Dial("tcp", addr, &tls.Config{}); err == nil {
+		tc.Close()
+		t.Error("Self-signed certificate accepted.")
+	}
+	time.Sleep(delay)
+
+	s := srv.Stats()
+	if s.HandshakeFailures["timeout"] != 1 || s.HandshakeFailures["not_tls"] != 1 ||
+		s.HandshakeFailures["alert"] != 1 || s.HandshakeFailures["protocol"] != 0 || s.Handshaking != 0 {
+		t.Errorf("Unexpected handshake stats: %v %v", s.Handshaking, s.HandshakeFailures)
+	}
+	if s.Accepted != 2 {
+		t.Errorf("Accepted %d connections, expected 2 (handshaken).", s.Accepted)
+	}
+	srv.Stop()
+	<-finish
+}
@@ -0,0 +1,67 @@
+package nserv
+
+import (
+	"net"
+)
+
+// Hooks observes lifecycle events of a Server (see Server.Hooks). The methods
+// are called synchronously by the server's goroutines, so they shouldn't block.
+// Embed NopHooks to implement only some of the methods.
+type Hooks interface {
+	// OnListen is called when the server starts serving on a listener with
+	// address addr.
+	OnListen(addr net.Addr)
+	// OnServe is called when the server starts accepting connections.
+	OnServe()
+	// OnStopRequested is called when the server is stopped (by Stop,
+	// ZeroDowntimeRestart, etc.).
+	OnStopRequested()
+	// OnDrainProgress is called periodically while a stopped server waits for
+	// its remaining connections to finish, see Server.Draining.
+	OnDrainProgress(p DrainProgress)
+	// OnDrainPhase is called when the graceful exit escalates to phase (see
+	// DrainPolicy), affecting n connections.
+	OnDrainPhase(phase DrainPhase, n int)
+	// OnStopped is called when Serve is about to return err (all connections
+	// are closed).
+	OnStopped(err error)
+	// OnHandoffStarted is called when a zero-downtime restart is about to
+	// launch a successor process with arguments args.
+	OnHandoffStarted(args []string)
+	// OnHandoffCompleted is called when a zero-downtime restart finished (err
+	// is nil if the successor process has been started).
+	OnHandoffCompleted(err error)
+	// OnLimitChanged is called when the throttling limit changes.
+	OnLimitChanged(old, new int)
+	// OnConnRejected is called when a connection from remote is rejected by
+	// admission control or the IP filter.
+	OnConnRejected(remote net.Addr)
+}
+
+// NopHooks implements Hooks with methods doing nothing.
+type NopHooks struct{}
+
+func (NopHooks) OnListen(net.Addr)             {}
+func (NopHooks) OnServe()                      {}
+func (NopHooks) OnStopRequested()              {}
+func (NopHooks) OnDrainProgress(DrainProgress) {}
+func (NopHooks) OnDrainPhase(DrainPhase, int)  {}
+func (NopHooks) OnStopped(error)               {}
+func (NopHooks) OnHandoffStarted([]string)     {}
+func (NopHooks) OnHandoffCompleted(error)      {}
+func (NopHooks) OnLimitChanged(int, int)       {}
+func (NopHooks) OnConnRejected(net.Addr)       {}
+
+// hooks returns hooks to be called by the server: srv.Hooks and logging to
+// srv.Logger (if set).
+func (srv *Server) hooks() Hooks {
+	switch {
+	case srv.Logger == nil && srv.Hooks == nil:
+		return NopHooks{}
+	case srv.Logger == nil:
+		return srv.Hooks
+	case srv.Hooks == nil:
+		return logHooks{srv.logger()}
+	}
+	return multiHooks{logHooks{srv.logger()}, srv.Hooks}
+}
@@ -0,0 +1,52 @@
+package nserv_test
+
+import (
+	"gopkg.in/kornel661/nserv.v0"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingHooks records names of the lifecycle events.
+type recordingHooks struct {
+	nserv.NopHooks
+	mu     sync.Mutex
+	events []string
+}
+
+func (h *recordingHooks) record(event string) {
+	h.mu.Lock()
+	h.events = append(h.events, event)
+	h.mu.Unlock()
+}
+
+func (h *recordingHooks) OnListen(net.Addr)       { h.record("listen") }
+func (h *recordingHooks) OnServe()                { h.record("serve") }
+func (h *recordingHooks) OnStopRequested()        { h.record("stop") }
+func (h *recordingHooks) OnStopped(error)         { h.record("stopped") }
+func (h *recordingHooks) OnLimitChanged(_, n int) { h.record("limit") }
+
+// TestHooks checks that lifecycle hooks are called in order.
+func TestHooks(t *testing.T) {
+	hooks := &recordingHooks{}
+	srv := newServer()
+	srv.Hooks = hooks
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	time.Sleep(delay)
+	srv.MaxConns(5)
+	srv.MaxConns(5) // no change
+	srv.Stop()
+	<-finish
+	expected := []string{"listen", "serve", "limit", "stop", "stopped"}
+	if !reflect.DeepEqual(hooks.events, expected) {
+		t.Errorf("Got events %v, expected %v.", hooks.events, expected)
+	}
+}
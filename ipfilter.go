@@ -0,0 +1,229 @@
+package nserv
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// IPFilter is a list of CIDR-based allow and deny rules applied to incoming
+// connections before throttling (see Server.IPFilter). A connection is
+// rejected if its source address matches a deny rule or if there are allow
+// rules and none of them matches. The rules can be updated at any time (see
+// Set and Reload). IPFilter is safe for concurrent use.
+type IPFilter struct {
+	mu        sync.RWMutex
+	allow     []*ipRule
+	deny      []*ipRule
+	path      string        // file the rules have been loaded from
+	unmatched atomic.Uint64 // connections rejected for not matching any allow rule
+}
+
+// IPRule describes a rule of an IPFilter, see IPFilter.Rules.
+type IPRule struct {
+	Allow   bool   `json:"allow"`   // allow (or deny) rule
+	Network string `json:"network"` // CIDR or IP address
+	Hits    uint64 `json:"hits"`    // number of connections the rule decided about
+}
+
+// ipRule is a parsed IPRule.
+type ipRule struct {
+	network *net.IPNet
+	text    string
+	hits    atomic.Uint64
+}
+
+// NewIPFilter returns a filter with the allow and deny rules (CIDRs or IP
+// addresses).
+func NewIPFilter(allow, deny []string) (*IPFilter, error) {
+	f := &IPFilter{}
+	if err := f.Set(allow, deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// LoadIPFilter returns a filter with the rules loaded from file path, see
+// Reload for the format.
+func LoadIPFilter(path string) (*IPFilter, error) {
+	f := &IPFilter{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Set replaces the rules of the filter. Hit counters of the rules kept are
+// preserved. On error the rules aren't changed.
+func (f *IPFilter) Set(allow, deny []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	a, err := parseIPRules(allow, f.allow)
+	if err != nil {
+		return err
+	}
+	d, err := parseIPRules(deny, f.deny)
+	if err != nil {
+		return err
+	}
+	f.allow, f.deny = a, d
+	return nil
+}
+
+// parseIPRules parses rules, reusing the matching rules from old.
+func parseIPRules(rules []string, old []*ipRule) ([]*ipRule, error) {
+	var parsed []*ipRule
+	for _, s := range rules {
+		n, err := parseNetwork(s)
+		if err != nil {
+			return nil, fmt.Errorf("nserv: IP filter: %v", err)
+		}
+		r := &ipRule{network: n, text: s}
+		for _, o := range old {
+			if o.text == s {
+				r = o
+				break
+			}
+		}
+		parsed = append(parsed, r)
+	}
+	return parsed, nil
+}
+
+// Reload reloads the rules from the file the filter has been loaded from (see
+// LoadIPFilter). The file has one rule per line, "allow <network>" or
+// "deny <network>"; empty lines and lines starting with # are ignored.
+func (f *IPFilter) Reload() error {
+	f.mu.RLock()
+	path := f.path
+	f.mu.RUnlock()
+	if path == "" {
+		return ErrNoIPFilterFile
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var allow, deny []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("nserv: %s:%d: expected allow|deny <network>", path, line)
+		}
+		switch fields[0] {
+		case "allow":
+			allow = append(allow, fields[1])
+		case "deny":
+			deny = append(deny, fields[1])
+		default:
+			return fmt.Errorf("nserv: %s:%d: unknown action %q", path, line, fields[0])
+		}
+	}
+	if err := f.Set(allow, deny); err != nil {
+		return fmt.Errorf("%v (%s)", err, path)
+	}
+	return nil
+}
+
+// Allowed tells if connections from address ip are allowed (and counts the
+// hit of the deciding rule).
+func (f *IPFilter) Allowed(ip net.IP) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, r := range f.deny {
+		if r.network.Contains(ip) {
+			r.hits.Add(1)
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, r := range f.allow {
+		if r.network.Contains(ip) {
+			r.hits.Add(1)
+			return true
+		}
+	}
+	f.unmatched.Add(1)
+	return false
+}
+
+// Rules returns the rules (allow rules first) with their hit counters.
+func (f *IPFilter) Rules() []IPRule {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	rules := make([]IPRule, 0, len(f.allow)+len(f.deny))
+	for _, r := range f.allow {
+		rules = append(rules, IPRule{true, r.text, r.hits.Load()})
+	}
+	for _, r := range f.deny {
+		rules = append(rules, IPRule{false, r.text, r.hits.Load()})
+	}
+	return rules
+}
+
+// Unmatched returns the number of connections rejected for not matching any
+// allow rule.
+func (f *IPFilter) Unmatched() uint64 {
+	return f.unmatched.Load()
+}
+
+// addrIP returns the IP address of addr (nil if it isn't an IP address, e.g.,
+// of a Unix socket).
+func addrIP(addr net.Addr) net.IP {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a.IP
+	}
+	return hostIP(addr.String())
+}
+
+// hostIP returns the IP address of host[:port] s (nil if there isn't any).
+func hostIP(s string) net.IP {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(s)
+}
+
+// allowedAddr tells if connections from addr are allowed (connections other
+// than IP ones, e.g., over Unix sockets, are).
+func (f *IPFilter) allowedAddr(addr net.Addr) bool {
+	ip := addrIP(addr)
+	return ip == nil || f.Allowed(ip)
+}
+
+// filterListener rejects connections from addresses not allowed by an
+// IPFilter (or the ban list).
+type filterListener struct {
+	net.Listener
+	allowed  func(net.Addr) bool
+	onReject func(net.Conn)
+}
+
+// Accept accepts the next allowed connection.
+func (l *filterListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil || l.allowed(c.RemoteAddr()) {
+			return c, err
+		}
+		l.onReject(c)
+		c.Close()
+	}
+}
+
+// File returns a copy of the underlying listener's file descriptor (for
+// zero-downtime restarts).
+func (l *filterListener) File() (*os.File, error) {
+	return listenerFile(l.Listener)
+}
@@ -0,0 +1,132 @@
+package nserv_test
+
+import (
+	"context"
+	"errors"
+	"gopkg.in/kornel661/nserv.v0"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestIPFilterRules checks matching of allow and deny rules.
+func TestIPFilterRules(t *testing.T) {
+	f, err := nserv.NewIPFilter([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.1.0.0/16", "10.2.3.4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, allowed := range map[string]bool{
+		"10.0.0.1":    true,
+		"10.1.2.3":    false,
+		"10.2.3.4":    false,
+		"10.2.3.5":    true,
+		"192.168.0.1": false,
+		"2001:db8::1": true,
+		"::1":         false,
+	} {
+		if f.Allowed(net.ParseIP(ip)) != allowed {
+			t.Errorf("Allowed(%s) should be %v.", ip, allowed)
+		}
+	}
+	want := []nserv.IPRule{
+		{Allow: true, Network: "10.0.0.0/8", Hits: 2},
+		{Allow: true, Network: "2001:db8::/32", Hits: 1},
+		{Allow: false, Network: "10.1.0.0/16", Hits: 1},
+		{Allow: false, Network: "10.2.3.4", Hits: 1},
+	}
+	rules := f.Rules()
+	if len(rules) != len(want) {
+		t.Fatalf("Unexpected rules: %+v", rules)
+	}
+	for i := range want {
+		if rules[i] != want[i] {
+			t.Errorf("Rule %d is %+v, expected %+v.", i, rules[i], want[i])
+		}
+	}
+	if f.Unmatched() != 2 {
+		t.Errorf("Unmatched %d connections.", f.Unmatched())
+	}
+	if err := f.Set(nil, []string{"10.0.0.0/33"}); err == nil {
+		t.Error("Invalid network accepted.")
+	}
+	if len(f.Rules()) != 4 {
+		t.Error("Rules changed by a failed Set.")
+	}
+	if err := f.Reload(); !errors.Is(err, nserv.ErrNoIPFilterFile) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+// TestIPFilterFile checks loading and reloading of a rules file.
+func TestIPFilterFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ipfilter")
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# blocked\ndeny 192.0.2.0/24\n\ndeny 198.51.100.7\n")
+	f, err := nserv.LoadIPFilter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Allowed(net.ParseIP("192.0.2.1"))
+	write("deny 192.0.2.0/24\nallow 127.0.0.1\n")
+	if err := f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	rules := f.Rules()
+	if len(rules) != 2 || rules[0].Network != "127.0.0.1" || rules[1].Hits != 1 {
+		t.Errorf("Unexpected rules after reload: %+v", rules)
+	}
+	write("block 192.0.2.0/24\n")
+	if err := f.Reload(); err == nil {
+		t.Error("Invalid file accepted.")
+	}
+	if len(f.Rules()) != 2 {
+		t.Error("Rules changed by a failed reload.")
+	}
+}
+
+// TestIPFilter checks that denied connections are closed before reaching the
+// server.
+func TestIPFilter(t *testing.T) {
+	srv := newServer()
+	srv.Handler = http.HandlerFunc(handler)
+	f, err := nserv.NewIPFilter(nil, []string{"127.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.IPFilter = f
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !closedWithin(c, time.Second) {
+		t.Error("Denied connection not closed.")
+	}
+	c.Close()
+	if s := srv.Stats(); s.Filtered != 1 || s.Accepted != 0 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+	// update at runtime
+	if err := f.Set(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	getFunc(t, "/allowed")
+	srv.Stop()
+	<-finish
+}
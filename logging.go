@@ -0,0 +1,195 @@
+package nserv
+
+import (
+	"log/slog"
+	"net"
+	"os/exec"
+)
+
+// Attribute keys of the records logged to Server.Logger. The keys are stable,
+// i.e., they won't change in future versions of the package.
+const (
+	LogKeyServer    = "server"    // server's label (Label or Addr)
+	LogKeyAddr      = "addr"      // listener's address
+	LogKeyRemote    = "remote"    // client's address
+	LogKeyError     = "error"     // error
+	LogKeyLimit     = "limit"     // throttling limit
+	LogKeyOldLimit  = "old_limit" // previous throttling limit
+	LogKeyRemaining = "remaining" // number of remaining connections
+	LogKeyOldest    = "oldest"    // age of the oldest remaining connection
+	LogKeyElapsed   = "elapsed"   // time since draining started
+	LogKeyEstimate  = "estimate"  // estimated time left (-1 if unknown)
+	LogKeyPhase     = "phase"     // drain phase
+	LogKeyAffected  = "affected"  // number of affected connections
+	LogKeyArgs      = "args"      // command line arguments of the successor process
+	LogKeyPID       = "pid"       // process ID of the successor process
+	LogKeyApplied   = "applied"   // configuration changes applied live
+	LogKeyRestart   = "restart"   // configuration changes requiring a restart
+	LogKeyReason    = "reason"    // reason of closing a connection (or of a ban)
+	LogKeyUntil     = "until"     // end of a ban, expiry of an OCSP response
+)
+
+// logger returns srv.Logger (with the server's label attached) or a logger
+// discarding all records.
+func (srv *Server) logger() *slog.Logger {
+	if srv.Logger == nil {
+		return discardLogger
+	}
+	return srv.Logger.With(LogKeyServer, srv.label())
+}
+
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// logAcceptError logs accept error err.
+func (srv *Server) logAcceptError(err error) {
+	srv.logger().Warn("accept error", LogKeyError, err)
+}
+
+// logHooks logs lifecycle events.
+type logHooks struct {
+	log *slog.Logger
+}
+
+func (h logHooks) OnListen(addr net.Addr) {
+	h.log.Info("listening", LogKeyAddr, addr.String())
+}
+
+func (h logHooks) OnServe() {
+	h.log.Info("serving")
+}
+
+func (h logHooks) OnStopRequested() {
+	h.log.Info("stop requested")
+}
+
+func (h logHooks) OnDrainProgress(p DrainProgress) {
+	if p.Remaining == 0 {
+		h.log.Info("drained", LogKeyElapsed, p.Elapsed)
+		return
+	}
+	h.log.Info("draining", LogKeyRemaining, p.Remaining, LogKeyOldest, p.OldestAge,
+		LogKeyElapsed, p.Elapsed, LogKeyEstimate, p.Estimate)
+}
+
+func (h logHooks) OnDrainPhase(phase DrainPhase, n int) {
+	h.log.Warn("drain phase", LogKeyPhase, phase.String(), LogKeyAffected, n)
+}
+
+func (h logHooks) OnStopped(err error) {
+	if err != nil {
+		h.log.Error("stopped", LogKeyError, err)
+	} else {
+		h.log.Info("stopped")
+	}
+}
+
+func (h logHooks) OnHandoffStarted(args []string) {
+	h.log.Info("handoff started", LogKeyArgs, args)
+}
+
+func (h logHooks) OnHandoffCompleted(err error) {
+	if err != nil {
+		h.log.Error("handoff failed", LogKeyError, err)
+	} else {
+		h.log.Info("handoff completed")
+	}
+}
+
+func (h logHooks) OnLimitChanged(old, new int) {
+	h.log.Info("limit changed", LogKeyOldLimit, old, LogKeyLimit, new)
+}
+
+func (h logHooks) OnConnRejected(remote net.Addr) {
+	h.log.Warn("connection rejected", LogKeyRemote, remote.String())
+}
+
+// multiHooks calls hooks in order.
+type multiHooks []Hooks
+
+func (hs multiHooks) OnListen(addr net.Addr) {
+	for _, h := range hs {
+		h.OnListen(addr)
+	}
+}
+
+func (hs multiHooks) OnServe() {
+	for _, h := range hs {
+		h.OnServe()
+	}
+}
+
+func (hs multiHooks) OnStopRequested() {
+	for _, h := range hs {
+		h.OnStopRequested()
+	}
+}
+
+func (hs multiHooks) OnDrainProgress(p DrainProgress) {
+	for _, h := range hs {
+		h.OnDrainProgress(p)
+	}
+}
+
+func (hs multiHooks) OnDrainPhase(phase DrainPhase, n int) {
+	for _, h := range hs {
+		h.OnDrainPhase(phase, n)
+	}
+}
+
+func (hs multiHooks) OnStopped(err error) {
+	for _, h := range hs {
+		h.OnStopped(err)
+	}
+}
+
+func (hs multiHooks) OnHandoffStarted(args []string) {
+	for _, h := range hs {
+		h.OnHandoffStarted(args)
+	}
+}
+
+func (hs multiHooks) OnHandoffCompleted(err error) {
+	for _, h := range hs {
+		h.OnHandoffCompleted(err)
+	}
+}
+
+func (hs multiHooks) OnLimitChanged(old, new int) {
+	for _, h := range hs {
+		h.OnLimitChanged(old, new)
+	}
+}
+
+func (hs multiHooks) OnConnRejected(remote net.Addr) {
+	for _, h := range hs {
+		h.OnConnRejected(remote)
+	}
+}
+
+// watchChild logs the start and exit of the successor process cmd.
+func (srv *Server) watchChild(cmd *exec.Cmd) {
+	log := srv.logger().With(LogKeyPID, cmd.Process.Pid)
+	log.Info("child process started")
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.Warn("child process exited", LogKeyError, err)
+		} else {
+			log.Info("child process exited")
+		}
+	}()
+}
+
+// logSaturation logs when the number of open connections reaches the
+// throttling limit and when it drops below the limit again.
+func (srv *Server) logSaturation(open int) {
+	limit := int(srv.stats.limit.Load())
+	saturated := open >= limit
+	if srv.stats.saturated.Swap(saturated) != saturated {
+		log := srv.logger()
+		if saturated {
+			log.Warn("throttling limit reached", LogKeyLimit, limit)
+		} else {
+			log.Debug("below throttling limit", LogKeyLimit, limit)
+		}
+	}
+}
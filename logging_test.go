@@ -0,0 +1,54 @@
+package nserv_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"gopkg.in/kornel661/nserv.v0"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+// TestLogger checks that lifecycle events are logged with stable keys.
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	srv := newServer()
+	srv.Logger = slog.New(slog.NewJSONHandler(&buf, nil))
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	time.Sleep(delay)
+	srv.MaxConns(3)
+	srv.Stop()
+	<-finish
+
+	var msgs []string
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var rec map[string]interface{}
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec[nserv.LogKeyServer] != addr {
+			t.Errorf("Record without server's label: %v", rec)
+		}
+		if rec["msg"] == "limit changed" && rec[nserv.LogKeyLimit] != 3.0 {
+			t.Errorf("Unexpected record: %v", rec)
+		}
+		msgs = append(msgs, rec["msg"].(string))
+	}
+	expected := []string{"listening", "serving", "limit changed", "stop requested", "drained", "stopped"}
+	if len(msgs) != len(expected) {
+		t.Fatalf("Got messages %q, expected %q.", msgs, expected)
+	}
+	for i := range msgs {
+		if msgs[i] != expected[i] {
+			t.Errorf("Got messages %q, expected %q.", msgs, expected)
+			break
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package nserv
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Maintenance describes the response served in maintenance mode (see
+// Server.SetMaintenance). Requests for allowed paths or from allowed networks
+// are served as usual.
+type Maintenance struct {
+	StatusCode    int           `json:"status_code,omitempty"`    // status code (default: 503)
+	ContentType   string        `json:"content_type,omitempty"`   // content type of Body (default: text/plain; charset=utf-8)
+	Body          string        `json:"body,omitempty"`           // response body (default: status text)
+	RetryAfter    time.Duration `json:"retry_after,omitempty"`    // if set, sent in the Retry-After header (in seconds)
+	AllowPaths    []string      `json:"allow_paths,omitempty"`    // path prefixes served as usual (e.g., health checks)
+	AllowNetworks []string      `json:"allow_networks,omitempty"` // source networks (CIDR or IP) served as usual
+}
+
+// maintenanceMode is a validated Maintenance.
+type maintenanceMode struct {
+	Maintenance
+	networks []*net.IPNet
+}
+
+// SetMaintenance switches the server to maintenance mode (or back to normal
+// operation if m is nil). In maintenance mode connections are accepted as
+// usual, but requests are answered with the response described by m. Requests
+// answered in maintenance mode are counted in Stats.
+//
+// Maintenance mode can be set at any time (also before the server starts) and
+// is passed on to the successor in a zero-downtime restart.
+func (srv *Server) SetMaintenance(m *Maintenance) error {
+	if m == nil {
+		if srv.maintenance.Swap(nil) != nil {
+			srv.logger().Info("maintenance mode off")
+		}
+		return nil
+	}
+	mm := &maintenanceMode{Maintenance: *m}
+	if mm.StatusCode == 0 {
+		mm.StatusCode = http.StatusServiceUnavailable
+	}
+	if mm.StatusCode < 100 || mm.StatusCode > 999 {
+		return fmt.Errorf("nserv: invalid maintenance status code %d", mm.StatusCode)
+	}
+	for _, s := range m.AllowNetworks {
+		n, err := parseNetwork(s)
+		if err != nil {
+			return fmt.Errorf("nserv: maintenance: %v", err)
+		}
+		mm.networks = append(mm.networks, n)
+	}
+	mm.AllowPaths = append([]string(nil), m.AllowPaths...)
+	mm.AllowNetworks = append([]string(nil), m.AllowNetworks...)
+	if srv.maintenance.Swap(mm) == nil {
+		srv.logger().Info("maintenance mode on")
+	}
+	return nil
+}
+
+// Maintenance returns the current maintenance mode settings (nil if the server
+// isn't in maintenance mode).
+func (srv *Server) Maintenance() *Maintenance {
+	mm := srv.maintenance.Load()
+	if mm == nil {
+		return nil
+	}
+	m := mm.Maintenance
+	return &m
+}
+
+// allows tells if request r is to be served as usual.
+func (mm *maintenanceMode) allows(r *http.Request) bool {
+	for _, p := range mm.AllowPaths {
+		if strings.HasPrefix(r.URL.Path, p) {
+			return true
+		}
+	}
+	if len(mm.networks) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range mm.networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP writes the maintenance response.
+func (mm *maintenanceMode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	ct, body := mm.ContentType, mm.Body
+	if ct == "" {
+		ct = "text/plain; charset=utf-8"
+	}
+	if body == "" {
+		body = http.StatusText(mm.StatusCode) + "\n"
+	}
+	h.Set("Content-Type", ct)
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	if mm.RetryAfter > 0 {
+		secs := (mm.RetryAfter + time.Second - 1) / time.Second
+		h.Set("Retry-After", strconv.FormatInt(int64(secs), 10))
+	}
+	w.WriteHeader(mm.StatusCode)
+	if r.Method != http.MethodHead {
+		w.Write([]byte(body))
+	}
+}
@@ -0,0 +1,60 @@
+package nserv_test
+
+import (
+	"context"
+	"gopkg.in/kornel661/nserv.v0"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestMaintenance checks the maintenance mode responses.
+func TestMaintenance(t *testing.T) {
+	srv := newServer()
+	srv.Handler = http.HandlerFunc(handler)
+	if err := srv.SetMaintenance(&nserv.Maintenance{AllowNetworks: []string{"bogus"}}); err == nil {
+		t.Error("Invalid network accepted.")
+	}
+	err := srv.SetMaintenance(&nserv.Maintenance{
+		Body:       "down for maintenance",
+		RetryAfter: 1500 * time.Millisecond,
+		AllowPaths: []string{"/health"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get("http://" + addr + "/maintenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || string(body) != "down for maintenance" {
+		t.Errorf("Got %d `%s`.", resp.StatusCode, body)
+	}
+	if ra := resp.Header.Get("Retry-After"); ra != "2" {
+		t.Errorf("Retry-After: %q", ra)
+	}
+	getFunc(t, "/health/check") // allowed
+	if s := srv.Stats(); !s.Maintenance || s.MaintenanceResponses != 1 || s.Requests != 2 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+	srv.SetMaintenance(nil)
+	getFunc(t, "/maintenance")
+	if s := srv.Stats(); s.Maintenance || s.MaintenanceResponses != 1 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+	srv.Stop()
+	<-finish
+}
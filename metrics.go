@@ -0,0 +1,140 @@
+package nserv
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MetricsHandler returns an http.Handler rendering statistics of the servers
+// srvs in the Prometheus text exposition format (version 0.0.4). Samples of
+// each server are labeled with server="<srv.Label>" (srv.Addr if Label is empty).
+//
+// Exported metrics:
+//
+//	nserv_state                        lifecycle state (1 for the current state)
+//	nserv_max_conns                    throttling limit
+//	nserv_connections                  connections by state (active, idle, queued, handshaking)
+//	nserv_connections_accepted_total   accepted connections
+//	nserv_connections_rejected_total   rejected connections by reason (admission, ip_filter, banned)
+//	nserv_accept_errors_total          accept errors
+//	nserv_received_bytes_total         bytes read from connections
+//	nserv_sent_bytes_total             bytes written to connections
+//	nserv_request_duration_seconds     histogram of request durations by status code
+//	nserv_handoffs_total               zero-downtime restarts performed
+//	nserv_uptime_seconds               time since the server started serving
+//	nserv_tls_handshake_failures_total failed TLS handshakes by reason
+func MetricsHandler(srvs ...*Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		writeMetrics(bw, srvs)
+		bw.Flush()
+	})
+}
+
+// metric is a single metric family.
+type metric struct {
+	name, typ, help string
+	samples         []sample
+}
+
+// sample is a single sample of a metric.
+type sample struct {
+	suffix string   // appended to the metric name, e.g., "_bucket"
+	labels []string // label names and values, alternating
+	value  float64
+}
+
+// writeMetrics writes metrics of servers srvs to w.
+func writeMetrics(w *bufio.Writer, srvs []*Server) {
+	metrics := []*metric{
+		{name: "nserv_state", typ: "gauge", help: "Lifecycle state of the server."},
+		{name: "nserv_max_conns", typ: "gauge", help: "Limit on simultaneous connections."},
+		{name: "nserv_connections", typ: "gauge", help: "Number of connections by state."},
+		{name: "nserv_connections_accepted_total", typ: "counter", help: "Number of accepted connections."},
+		{name: "nserv_connections_rejected_total", typ: "counter", help: "Number of rejected connections by reason."},
+		{name: "nserv_accept_errors_total", typ: "counter", help: "Number of accept errors."},
+		{name: "nserv_received_bytes_total", typ: "counter", help: "Number of bytes read from connections."},
+		{name: "nserv_sent_bytes_total", typ: "counter", help: "Number of bytes written to connections."},
+		{name: "nserv_request_duration_seconds", typ: "histogram", help: "Duration of requests by status code."},
+		{name: "nserv_handoffs_total", typ: "counter", help: "Number of zero-downtime restarts performed."},
+		{name: "nserv_uptime_seconds", typ: "gauge", help: "Time since the server started serving."},
+		{name: "nserv_tls_handshake_failures_total", typ: "counter", help: "Number of failed TLS handshakes by reason."},
+	}
+	add := func(i int, suffix string, value float64, labels ...string) {
+		metrics[i].samples = append(metrics[i].samples, sample{suffix, labels, value})
+	}
+	for _, srv := range srvs {
+		name := srv.label()
+		s := srv.Stats()
+		for st := StateNew; st <= StateHandedOff; st++ {
+			v := 0.0
+			if st == s.State {
+				v = 1
+			}
+			add(0, "", v, "server", name, "state", st.String())
+		}
+		add(1, "", float64(s.Limit), "server", name)
+		add(2, "", float64(s.Active), "server", name, "state", "active")
+		add(2, "", float64(s.Idle), "server", name, "state", "idle")
+		add(2, "", float64(s.Queued), "server", name, "state", "queued")
+		add(2, "", float64(s.Handshaking), "server", name, "state", "handshaking")
+		add(3, "", float64(s.Accepted), "server", name)
+		add(4, "", float64(s.Rejected), "server", name, "reason", "admission")
+		add(4, "", float64(s.Filtered), "server", name, "reason", "ip_filter")
+		add(4, "", float64(s.Banned), "server", name, "reason", "banned")
+		add(5, "", float64(s.AcceptErrors), "server", name)
+		add(6, "", float64(s.BytesIn), "server", name)
+		add(7, "", float64(s.BytesOut), "server", name)
+		durations := srv.stats.durations.snapshot()
+		codes := make([]int, 0, len(durations))
+		for code := range durations {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			h := durations[code]
+			c := strconv.Itoa(code)
+			for i, le := range durationBuckets {
+				add(8, "_bucket", float64(h.buckets[i]), "server", name, "code", c,
+					"le", strconv.FormatFloat(le, 'g', -1, 64))
+			}
+			add(8, "_bucket", float64(h.count), "server", name, "code", c, "le", "+Inf")
+			add(8, "_sum", h.sum, "server", name, "code", c)
+			add(8, "_count", float64(h.count), "server", name, "code", c)
+		}
+		add(9, "", float64(s.Handoffs), "server", name)
+		add(10, "", s.Uptime.Seconds(), "server", name)
+		for _, reason := range handshakeReasonNames {
+			add(11, "", float64(s.HandshakeFailures[reason]), "server", name, "reason", reason)
+		}
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for _, s := range m.samples {
+			w.WriteString(m.name + s.suffix)
+			if len(s.labels) > 0 {
+				w.WriteByte('{')
+				for i := 0; i < len(s.labels); i += 2 {
+					if i > 0 {
+						w.WriteByte(',')
+					}
+					fmt.Fprintf(w, "%s=\"%s\"", s.labels[i], escapeLabel(s.labels[i+1]))
+				}
+				w.WriteByte('}')
+			}
+			fmt.Fprintf(w, " %s\n", strconv.FormatFloat(s.value, 'g', -1, 64))
+		}
+	}
+}
+
+// labelEscaper escapes label values as required by the text exposition format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,70 @@
+package nserv_test
+
+import (
+	"gopkg.in/kornel661/nserv.v0"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMetricsHandler checks the Prometheus metrics rendered by MetricsHandler.
+func TestMetricsHandler(t *testing.T) {
+	srv := newServer()
+	srv.InitialMaxConns = 7
+	srv.Handler = http.HandlerFunc(handler)
+	f, err := nserv.NewIPFilter(nil, []string{"127.0.0.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.IPFilter = f
+	srv.BanPolicy = &nserv.BanPolicy{}
+	nserv.AddBans(srv, []nserv.Ban{{IP: "127.0.0.3", Until: time.Now().Add(time.Hour)}})
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	time.Sleep(delay)
+	getFunc(t, "/metrics")
+	for _, ip := range []string{"127.0.0.2", "127.0.0.3"} { // filtered, banned
+		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+		c, err := d.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !closedWithin(c, time.Second) {
+			t.Errorf("Connection from %s not rejected.", ip)
+		}
+		c.Close()
+	}
+
+	rec := httptest.NewRecorder()
+	nserv.MetricsHandler(srv).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE nserv_request_duration_seconds histogram",
+		`nserv_state{server="` + addr + `",state="serving"} 1`,
+		`nserv_max_conns{server="` + addr + `"} 7`,
+		`nserv_connections_accepted_total{server="` + addr + `"} 1`,
+		`nserv_connections_rejected_total{server="` + addr + `",reason="admission"} 0`,
+		`nserv_connections_rejected_total{server="` + addr + `",reason="ip_filter"} 1`,
+		`nserv_connections_rejected_total{server="` + addr + `",reason="banned"} 1`,
+		`nserv_request_duration_seconds_count{server="` + addr + `",code="200"} 1`,
+		`nserv_request_duration_seconds_bucket{server="` + addr + `",code="200",le="+Inf"} 1`,
+		`nserv_handoffs_total{server="` + addr + `"} 0`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Metrics don't contain %q.", line)
+		}
+	}
+	if t.Failed() {
+		t.Log(body)
+	}
+	srv.Stop()
+	<-finish
+}
@@ -0,0 +1,341 @@
+package nserv
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// OCSPPolicy configures OCSP stapling by ListenAndServeTLS (see Server.OCSP).
+// The OCSP response for the server's certificate is fetched from the
+// responder in the background (right away, then periodically and whenever the
+// certificate is reloaded) and stapled to TLS handshakes. The certificate file
+// has to contain the issuer's certificate (following the server's one). If the
+// responder can't be reached, the last valid response is served until it
+// expires.
+type OCSPPolicy struct {
+	// Responder is the URL of the OCSP responder (default: the first one
+	// listed in the certificate).
+	Responder string
+	// Refresh is the maximum time between fetches of the response (default:
+	// DefaultOCSPRefresh). Responses are refreshed at the latest halfway to
+	// their expiry.
+	Refresh time.Duration
+	// Retry is the time between fetches after a failure (default:
+	// DefaultOCSPRetry).
+	Retry time.Duration
+	// Client is used to query the responder (default: http.Client with
+	// DefaultOCSPTimeout).
+	Client *http.Client
+}
+
+// Defaults of OCSPPolicy.
+var (
+	DefaultOCSPRefresh = time.Hour
+	DefaultOCSPRetry   = time.Minute
+	DefaultOCSPTimeout = 10 * time.Second
+)
+
+// ocspState holds the state of OCSP stapling.
+type ocspState struct {
+	once   sync.Once
+	kickCh chan struct{} // signals that the certificate has changed
+}
+
+// kicked returns the channel signalling that the certificate has changed.
+func (o *ocspState) kicked() chan struct{} {
+	o.once.Do(func() { o.kickCh = make(chan struct{}, 1) })
+	return o.kickCh
+}
+
+// kick makes the background fetcher refresh the response (if running).
+func (o *ocspState) kick() {
+	select {
+	case o.kicked() <- struct{}{}:
+	default: // pending already
+	}
+}
+
+// Statuses of certificates in OCSP responses.
+const (
+	ocspGood    = 0
+	ocspRevoked = 1
+	ocspUnknown = 2
+)
+
+var ocspStatusNames = [...]string{"good", "revoked", "unknown"}
+
+var (
+	oidSHA1           = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidOCSPBasic      = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	ocspSigAlgorithms = map[string]x509.SignatureAlgorithm{
+		"1.2.840.113549.1.1.5":  x509.SHA1WithRSA,
+		"1.2.840.113549.1.1.11": x509.SHA256WithRSA,
+		"1.2.840.113549.1.1.12": x509.SHA384WithRSA,
+		"1.2.840.113549.1.1.13": x509.SHA512WithRSA,
+		"1.2.840.10045.4.3.2":   x509.ECDSAWithSHA256,
+		"1.2.840.10045.4.3.3":   x509.ECDSAWithSHA384,
+		"1.2.840.10045.4.3.4":   x509.ECDSAWithSHA512,
+		"1.3.101.112":           x509.PureEd25519,
+	}
+)
+
+// ASN.1 structures of OCSP (RFC 6960), only the parts used here.
+type (
+	ocspCertID struct {
+		HashAlgorithm pkix.AlgorithmIdentifier
+		NameHash      []byte
+		KeyHash       []byte
+		SerialNumber  *big.Int
+	}
+	ocspRequest struct {
+		TBSRequest struct {
+			Version     int `asn1:"explicit,tag:0,default:0,optional"`
+			RequestList []struct {
+				CertID ocspCertID
+			}
+		}
+	}
+	ocspResponse struct {
+		Status        asn1.Enumerated
+		ResponseBytes struct {
+			ResponseType asn1.ObjectIdentifier
+			Response     []byte
+		} `asn1:"explicit,tag:0,optional"`
+	}
+	ocspBasicResponse struct {
+		TBSResponseData struct {
+			Raw         asn1.RawContent
+			Version     int `asn1:"optional,default:0,explicit,tag:0"`
+			ResponderID asn1.RawValue
+			ProducedAt  time.Time `asn1:"generalized"`
+			Responses   []ocspSingleResponse
+		}
+		SignatureAlgorithm pkix.AlgorithmIdentifier
+		Signature          asn1.BitString
+		Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+	}
+	ocspSingleResponse struct {
+		CertID     ocspCertID
+		Good       asn1.Flag     `asn1:"tag:0,optional"`
+		Revoked    asn1.RawValue `asn1:"tag:1,optional"`
+		Unknown    asn1.Flag     `asn1:"tag:2,optional"`
+		ThisUpdate time.Time     `asn1:"generalized"`
+		NextUpdate time.Time     `asn1:"generalized,explicit,tag:0,optional"`
+	}
+)
+
+// ocspCertIDOf returns the CertID of certificate leaf issued by issuer.
+func ocspCertIDOf(leaf, issuer *x509.Certificate) (ocspCertID, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return ocspCertID{}, err
+	}
+	nameHash := sha1.Sum(issuer.RawSubject)
+	keyHash := sha1.Sum(spki.PublicKey.RightAlign())
+	return ocspCertID{
+		HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+		NameHash:      nameHash[:],
+		KeyHash:       keyHash[:],
+		SerialNumber:  leaf.SerialNumber,
+	}, nil
+}
+
+// parseOCSPResponse verifies OCSP response der for the certificate id issued
+// by issuer, returns the certificate's status and the response's expiry.
+func parseOCSPResponse(der []byte, id ocspCertID, issuer *x509.Certificate) (status int, nextUpdate time.Time, err error) {
+	var resp ocspResponse
+	if _, err := asn1.Unmarshal(der, &resp); err != nil {
+		return 0, time.Time{}, err
+	}
+	if resp.Status != 0 {
+		return 0, time.Time{}, fmt.Errorf("OCSP responder returned status %d", resp.Status)
+	}
+	if !resp.ResponseBytes.ResponseType.Equal(oidOCSPBasic) {
+		return 0, time.Time{}, errors.New("unsupported OCSP response type")
+	}
+	var basic ocspBasicResponse
+	if _, err := asn1.Unmarshal(resp.ResponseBytes.Response, &basic); err != nil {
+		return 0, time.Time{}, err
+	}
+	// the response is signed by the issuer or by a responder it delegated to
+	signer := issuer
+	if len(basic.Certificates) > 0 {
+		if signer, err = x509.ParseCertificate(basic.Certificates[0].FullBytes); err != nil {
+			return 0, time.Time{}, err
+		}
+		if !signer.Equal(issuer) {
+			if err := signer.CheckSignatureFrom(issuer); err != nil {
+				return 0, time.Time{}, fmt.Errorf("OCSP responder's certificate: %v", err)
+			}
+			delegated := false
+			for _, u := range signer.ExtKeyUsage {
+				delegated = delegated || u == x509.ExtKeyUsageOCSPSigning
+			}
+			if !delegated {
+				return 0, time.Time{}, errors.New("OCSP responder's certificate isn't authorized to sign responses")
+			}
+		}
+	}
+	algo, ok := ocspSigAlgorithms[basic.SignatureAlgorithm.Algorithm.String()]
+	if !ok {
+		return 0, time.Time{}, fmt.Errorf("unsupported OCSP signature algorithm %v", basic.SignatureAlgorithm.Algorithm)
+	}
+	if err := signer.CheckSignature(algo, basic.TBSResponseData.Raw, basic.Signature.RightAlign()); err != nil {
+		return 0, time.Time{}, fmt.Errorf("OCSP response signature: %v", err)
+	}
+	for _, r := range basic.TBSResponseData.Responses {
+		if r.CertID.SerialNumber == nil || r.CertID.SerialNumber.Cmp(id.SerialNumber) != 0 ||
+			!r.CertID.HashAlgorithm.Algorithm.Equal(oidSHA1) ||
+			!bytes.Equal(r.CertID.NameHash, id.NameHash) || !bytes.Equal(r.CertID.KeyHash, id.KeyHash) {
+			continue
+		}
+		switch {
+		case bool(r.Good):
+			status = ocspGood
+		case len(r.Revoked.FullBytes) > 0:
+			status = ocspRevoked
+		default:
+			status = ocspUnknown
+		}
+		if !r.NextUpdate.IsZero() && time.Now().After(r.NextUpdate) {
+			return 0, time.Time{}, errors.New("OCSP response expired")
+		}
+		return status, r.NextUpdate, nil
+	}
+	return 0, time.Time{}, errors.New("OCSP response doesn't cover the certificate")
+}
+
+// RefreshOCSP fetches the OCSP response for the server's certificate right
+// away and staples it (see OCSPPolicy). If it fails, the last valid response
+// is kept. Returns ErrNoOCSP if OCSP stapling isn't configured and
+// ErrNoCertificates if no certificate has been loaded.
+func (srv *Server) RefreshOCSP() error {
+	_, err := srv.refreshOCSP()
+	return err
+}
+
+// refreshOCSP implements RefreshOCSP, returns the expiry of the response.
+func (srv *Server) refreshOCSP() (nextUpdate time.Time, err error) {
+	p := srv.OCSP
+	if p == nil {
+		return time.Time{}, ErrNoOCSP
+	}
+	c := srv.certificate.Load()
+	if c == nil {
+		return time.Time{}, ErrNoCertificates
+	}
+	der, status, nextUpdate, err := fetchOCSP(p, c.cert)
+	if err != nil {
+		srv.logger().Warn("can't fetch OCSP response", LogKeyError, err)
+		return time.Time{}, err
+	}
+	if status == ocspUnknown {
+		err = errors.New("nserv: OCSP responder doesn't know the certificate")
+		srv.logger().Warn("can't fetch OCSP response", LogKeyError, err)
+		return time.Time{}, err
+	}
+	if status == ocspRevoked {
+		srv.logger().Error("certificate revoked (according to OCSP)")
+	}
+	stapled := *c.cert
+	stapled.OCSPStaple = der
+	c.staple.Store(&ocspStaple{&stapled, nextUpdate})
+	srv.logger().Info("OCSP response stapled", LogKeyReason, ocspStatusNames[status], LogKeyUntil, nextUpdate)
+	return nextUpdate, nil
+}
+
+// fetchOCSP fetches and verifies the OCSP response for cert.
+func fetchOCSP(p *OCSPPolicy, cert *tls.Certificate) (der []byte, status int, nextUpdate time.Time, err error) {
+	if len(cert.Certificate) < 2 {
+		return nil, 0, time.Time{}, errors.New("nserv: OCSP: no issuer certificate in the chain")
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, 0, time.Time{}, err
+		}
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	responder := p.Responder
+	if responder == "" {
+		if len(leaf.OCSPServer) == 0 {
+			return nil, 0, time.Time{}, errors.New("nserv: OCSP: no responder")
+		}
+		responder = leaf.OCSPServer[0]
+	}
+	id, err := ocspCertIDOf(leaf, issuer)
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	var req ocspRequest
+	req.TBSRequest.RequestList = append(req.TBSRequest.RequestList, struct{ CertID ocspCertID }{id})
+	body, err := asn1.Marshal(req)
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: DefaultOCSPTimeout}
+	}
+	resp, err := client.Post(responder, "application/ocsp-request", bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, time.Time{}, fmt.Errorf("nserv: OCSP responder: %s", resp.Status)
+	}
+	if der, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20)); err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	if status, nextUpdate, err = parseOCSPResponse(der, id, issuer); err != nil {
+		return nil, 0, time.Time{}, fmt.Errorf("nserv: %v", err)
+	}
+	return der, status, nextUpdate, nil
+}
+
+// ocspFetcher refreshes the OCSP response according to policy p until done
+// is closed.
+func (srv *Server) ocspFetcher(p *OCSPPolicy, done <-chan struct{}) {
+	refresh, retry := p.Refresh, p.Retry
+	if refresh <= 0 {
+		refresh = DefaultOCSPRefresh
+	}
+	if retry <= 0 {
+		retry = DefaultOCSPRetry
+	}
+	for {
+		wait := refresh
+		if nextUpdate, err := srv.refreshOCSP(); err != nil {
+			wait = retry
+		} else if half := time.Until(nextUpdate) / 2; !nextUpdate.IsZero() && half < wait {
+			wait = max(half, retry)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-srv.ocsp.kicked():
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
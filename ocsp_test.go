@@ -0,0 +1,252 @@
+package nserv_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"gopkg.in/kornel661/nserv.v0"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCertID is the CertID of OCSP requests (RFC 6960).
+type testCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	KeyHash       []byte
+	SerialNumber  *big.Int
+}
+
+// testOCSPResponder is a stand-in OCSP responder answering "good" for the
+// certificate with serial number serial issued by ca.
+type testOCSPResponder struct {
+	ca     *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial *big.Int
+	down   atomic.Bool // respond with 503
+	mu     sync.Mutex
+	last   []byte // the last response
+}
+
+func (r *testOCSPResponder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.down.Load() {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	var ocspReq struct {
+		TBSRequest struct {
+			RequestList []struct {
+				CertID asn1.RawValue
+			}
+		}
+	}
+	var id testCertID
+	if _, err := asn1.Unmarshal(body, &ocspReq); err != nil || len(ocspReq.TBSRequest.RequestList) != 1 {
+		http.Error(w, "malformed request", http.StatusBadRequest)
+		return
+	}
+	rawID := ocspReq.TBSRequest.RequestList[0].CertID
+	nameHash := sha1.Sum(r.ca.RawSubject)
+	if _, err := asn1.Unmarshal(rawID.FullBytes, &id); err != nil ||
+		id.SerialNumber.Cmp(r.serial) != 0 || !bytes.Equal(id.NameHash, nameHash[:]) {
+		http.Error(w, "unknown certificate", http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	type singleResponse struct {
+		CertID     asn1.RawValue
+		Good       asn1.RawValue
+		ThisUpdate time.Time `asn1:"generalized"`
+		NextUpdate time.Time `asn1:"generalized,explicit,tag:0"`
+	}
+	tbs, err := asn1.Marshal(struct {
+		ResponderID asn1.RawValue
+		ProducedAt  time.Time `asn1:"generalized"`
+		Responses   []singleResponse
+	}{
+		ResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: r.ca.RawSubject},
+		ProducedAt:  now,
+		Responses: []singleResponse{{
+			CertID:     rawID,
+			Good:       asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0},
+			ThisUpdate: now,
+			NextUpdate: now.Add(time.Hour),
+		}},
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	digest := sha256.Sum256(tbs)
+	sig, err := ecdsa.SignASN1(rand.Reader, r.key, digest[:])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	basic, _ := asn1.Marshal(struct {
+		TBSResponseData    asn1.RawValue
+		SignatureAlgorithm pkix.AlgorithmIdentifier
+		Signature          asn1.BitString
+	}{
+		TBSResponseData:    asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+		Signature:          asn1.BitString{Bytes: sig, BitLength: 8 * len(sig)},
+	})
+	type responseBytes struct {
+		ResponseType asn1.ObjectIdentifier
+		Response     []byte
+	}
+	resp, _ := asn1.Marshal(struct {
+		Status        asn1.Enumerated
+		ResponseBytes responseBytes `asn1:"explicit,tag:0"`
+	}{
+		ResponseBytes: responseBytes{asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}, basic},
+	})
+	r.mu.Lock()
+	r.last = resp
+	r.mu.Unlock()
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(resp)
+}
+
+// writeTestChain writes a certificate for localhost issued by a test CA
+// (followed by the CA's certificate) and its key to a temporary directory,
+// returns the file names and a stand-in OCSP responder for the certificate.
+// The certificate points at the responder.
+func writeTestChain(t *testing.T) (certFile, keyFile string, responder *testOCSPResponder) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "nserv test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder = &testOCSPResponder{ca: ca, key: caKey, serial: big.NewInt(42)}
+	ts := httptest.NewServer(responder)
+	t.Cleanup(ts.Close)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: responder.serial,
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		OCSPServer:   []string{ts.URL},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "chain.pem"), filepath.Join(dir, "key.pem")
+	chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})...)
+	if err := os.WriteFile(certFile, chain, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, responder
+}
+
+// TestOCSPStapling checks that OCSP responses are fetched and stapled, and
+// that the last good one is served while the responder is down.
+func TestOCSPStapling(t *testing.T) {
+	certFile, keyFile, responder := writeTestChain(t)
+	srv := newServer()
+	srv.Handler = http.HandlerFunc(handler)
+	if err := srv.RefreshOCSP(); !errors.Is(err, nserv.ErrNoOCSP) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	srv.OCSP = &nserv.OCSPPolicy{Refresh: time.Hour, Retry: time.Hour}
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServeTLS(certFile, keyFile); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+		t.Fatal(err)
+	}
+	stapled := func() []byte {
+		c, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		return c.ConnectionState().OCSPResponse
+	}
+	var staple []byte
+	for deadline := time.Now().Add(5 * time.Second); staple == nil && time.Now().Before(deadline); {
+		if staple = stapled(); staple == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	responder.mu.Lock()
+	last := responder.last
+	responder.mu.Unlock()
+	if staple == nil || !bytes.Equal(staple, last) {
+		t.Fatalf("OCSP response not stapled (%d bytes, responder sent %d).", len(staple), len(last))
+	}
+
+	responder.down.Store(true)
+	if err := srv.RefreshOCSP(); err == nil {
+		t.Error("Refreshed with the responder down.")
+	}
+	if !bytes.Equal(stapled(), staple) {
+		t.Error("The last good OCSP response not served with the responder down.")
+	}
+	responder.down.Store(false)
+	if err := srv.RefreshOCSP(); err != nil {
+		t.Error(err)
+	}
+	srv.Stop()
+	<-finish
+}
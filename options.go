@@ -0,0 +1,101 @@
+package nserv
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Option configures a Server created by NewServer.
+type Option func(*Server)
+
+// serverDefaults are the values of a Server's settings applied if they're
+// zero when the server is started by the ListenAndServe family (or
+// ResumeAndServe).
+type serverDefaults struct {
+	readTimeout       time.Duration
+	readHeaderTimeout time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+	maxConns          int
+}
+
+// NewServer returns a new Server configured by options opts. The defaults
+// (DefaultReadTimeout, DefaultWriteTimeout and DefaultMaxConns, unless
+// overridden by the options) are captured by the server, so that changes of
+// the package-level variables don't affect it. The defaults are applied right
+// away and again whenever the server is started with the corresponding
+// settings zeroed.
+func NewServer(opts ...Option) *Server {
+	srv := &Server{defaults: &serverDefaults{
+		readTimeout:  DefaultReadTimeout,
+		writeTimeout: DefaultWriteTimeout,
+		maxConns:     DefaultMaxConns,
+	}}
+	for _, opt := range opts {
+		opt(srv)
+	}
+	srv.saneDefaults()
+	return srv
+}
+
+// WithAddr sets the TCP address to listen on (see http.Server.Addr).
+func WithAddr(addr string) Option {
+	return func(srv *Server) { srv.Addr = addr }
+}
+
+// WithHandler sets the handler (see http.Server.Handler).
+func WithHandler(h http.Handler) Option {
+	return func(srv *Server) { srv.Handler = h }
+}
+
+// WithLabel sets the name of the server in statistics (see Server.Label).
+func WithLabel(label string) Option {
+	return func(srv *Server) { srv.Label = label }
+}
+
+// WithLogger sets the structured logger (see Server.Logger).
+func WithLogger(l *slog.Logger) Option {
+	return func(srv *Server) { srv.Logger = l }
+}
+
+// WithReadTimeout sets the default http.Server.ReadTimeout.
+func WithReadTimeout(d time.Duration) Option {
+	return func(srv *Server) { srv.defaults.readTimeout = d }
+}
+
+// WithReadHeaderTimeout sets the default http.Server.ReadHeaderTimeout.
+func WithReadHeaderTimeout(d time.Duration) Option {
+	return func(srv *Server) { srv.defaults.readHeaderTimeout = d }
+}
+
+// WithWriteTimeout sets the default http.Server.WriteTimeout.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(srv *Server) { srv.defaults.writeTimeout = d }
+}
+
+// WithIdleTimeout sets the default http.Server.IdleTimeout.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(srv *Server) { srv.defaults.idleTimeout = d }
+}
+
+// WithMaxHeaderBytes sets the default http.Server.MaxHeaderBytes.
+func WithMaxHeaderBytes(n int) Option {
+	return func(srv *Server) { srv.defaults.maxHeaderBytes = n }
+}
+
+// WithMaxConnAge sets Server.MaxConnAge.
+func WithMaxConnAge(d time.Duration) Option {
+	return func(srv *Server) { srv.MaxConnAge = d }
+}
+
+// WithMaxRequestsPerConn sets Server.MaxRequestsPerConn.
+func WithMaxRequestsPerConn(n int) Option {
+	return func(srv *Server) { srv.MaxRequestsPerConn = n }
+}
+
+// WithMaxConns sets the default Server.InitialMaxConns.
+func WithMaxConns(n int) Option {
+	return func(srv *Server) { srv.defaults.maxConns = n }
+}
@@ -0,0 +1,45 @@
+package nserv_test
+
+import (
+	"context"
+	"gopkg.in/kornel661/nserv.v0"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestNewServer checks that NewServer captures the defaults.
+func TestNewServer(t *testing.T) {
+	srv := nserv.NewServer(
+		nserv.WithAddr(addr),
+		nserv.WithHandler(http.HandlerFunc(handler)),
+		nserv.WithIdleTimeout(time.Minute),
+		nserv.WithMaxHeaderBytes(1<<16),
+		nserv.WithMaxConns(3),
+	)
+	if srv.ReadTimeout != nserv.DefaultReadTimeout || srv.IdleTimeout != time.Minute ||
+		srv.MaxHeaderBytes != 1<<16 || srv.InitialMaxConns != 3 {
+		t.Errorf("Defaults not applied: %+v", srv)
+	}
+	// changes of the package-level defaults don't affect the server
+	old := nserv.DefaultMaxConns
+	nserv.DefaultMaxConns = 99
+	defer func() { nserv.DefaultMaxConns = old }()
+	srv.InitialMaxConns, srv.IdleTimeout = 0, 0
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+		t.Fatal(err)
+	}
+	getFunc(t, "/options")
+	if s := srv.Stats(); s.Limit != 3 || srv.IdleTimeout != time.Minute {
+		t.Errorf("Limit %d, idle timeout %v.", s.Limit, srv.IdleTimeout)
+	}
+	srv.Stop()
+	<-finish
+}
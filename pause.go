@@ -0,0 +1,144 @@
+package nserv
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Pause stops accepting new connections without closing the listener: the
+// socket stays bound and incoming connections wait in the kernel's backlog
+// until Resume is called. Established connections are served as usual.
+// Returns false if the server isn't serving or is already paused.
+//
+// Unlike Stop, Pause is temporary. Stopping a paused server stops it as
+// usual.
+func (srv *Server) Pause() bool {
+	srv.mu.Lock()
+	pl := srv.pauser
+	ok := srv.State() == StateServing && pl != nil && pl.pause()
+	if ok {
+		srv.stats.paused.Store(true)
+	}
+	srv.mu.Unlock()
+	if ok {
+		srv.logger().Info("paused")
+	}
+	return ok
+}
+
+// Resume resumes accepting connections after Pause. Returns false if the
+// server isn't paused.
+func (srv *Server) Resume() bool {
+	srv.mu.Lock()
+	pl := srv.pauser
+	ok := pl != nil && pl.resume()
+	if ok {
+		srv.stats.paused.Store(false)
+	}
+	srv.mu.Unlock()
+	if ok {
+		srv.logger().Info("resumed")
+	}
+	return ok
+}
+
+// Paused reports whether the server has been paused (see Pause).
+func (srv *Server) Paused() bool {
+	return srv.stats.paused.Load()
+}
+
+// pauseListener is a listener whose Accept can be suspended. It's the
+// innermost layer of the listener chain, so that nothing (e.g., admission
+// control) takes connections off the backlog while paused.
+type pauseListener struct {
+	net.Listener
+	mu     sync.Mutex
+	cond   *sync.Cond // signaled on resume and close
+	paused bool
+	closed bool
+	gen    uint64 // incremented on each pause
+}
+
+func newPauseListener(l net.Listener) *pauseListener {
+	pl := &pauseListener{Listener: l}
+	pl.cond = sync.NewCond(&pl.mu)
+	return pl
+}
+
+// Accept waits while the listener is paused, then accepts a connection.
+func (l *pauseListener) Accept() (net.Conn, error) {
+	for {
+		l.mu.Lock()
+		for l.paused && !l.closed {
+			l.cond.Wait()
+		}
+		closed, gen := l.closed, l.gen
+		l.mu.Unlock()
+		if closed {
+			return nil, net.ErrClosed
+		}
+		c, err := l.Listener.Accept()
+		if err != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+			l.mu.Lock()
+			interrupted := l.gen != gen
+			l.mu.Unlock()
+			if interrupted { // by pause, see interrupt
+				continue
+			}
+		}
+		return c, err
+	}
+}
+
+// pause suspends Accept, returns false if already paused or closed.
+func (l *pauseListener) pause() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.paused || l.closed {
+		return false
+	}
+	l.paused = true
+	l.gen++
+	l.setDeadline(time.Now()) // interrupt pending Accept
+	return true
+}
+
+// resume resumes Accept, returns false if not paused.
+func (l *pauseListener) resume() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.paused {
+		return false
+	}
+	l.paused = false
+	l.setDeadline(time.Time{})
+	l.cond.Broadcast()
+	return true
+}
+
+// setDeadline sets the accept deadline of the underlying listener (if
+// supported). Without the deadline, a pending Accept takes one more connection
+// after pause.
+func (l *pauseListener) setDeadline(t time.Time) {
+	if dl, ok := l.Listener.(interface{ SetDeadline(time.Time) error }); ok {
+		dl.SetDeadline(t)
+	}
+}
+
+// Close closes the listener, pending Accept calls return net.ErrClosed.
+func (l *pauseListener) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	l.cond.Broadcast()
+	l.mu.Unlock()
+	return l.Listener.Close()
+}
+
+// File returns a copy of the underlying listener's file descriptor (for
+// zero-downtime restarts).
+func (l *pauseListener) File() (*os.File, error) {
+	return listenerFile(l.Listener)
+}
@@ -0,0 +1,65 @@
+package nserv_test
+
+import (
+	"context"
+	"gopkg.in/kornel661/nserv.v0"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestPause checks that a paused server doesn't accept connections, but keeps
+// them in the backlog until resumed.
+func TestPause(t *testing.T) {
+	srv := newServer()
+	srv.Handler = http.HandlerFunc(handler)
+	if srv.Pause() {
+		t.Error("Paused a server that isn't serving.")
+	}
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+		t.Fatal(err)
+	}
+	getFunc(t, "/before")
+	http.DefaultClient.CloseIdleConnections() // need a new connection
+	if !srv.Pause() || srv.Pause() {
+		t.Error("Pause should succeed exactly once.")
+	}
+	if s := srv.Stats(); !s.Paused || !srv.Paused() {
+		t.Errorf("Not paused: %+v", s)
+	}
+	got := make(chan struct{})
+	go func() {
+		getFunc(t, "/paused")
+		close(got)
+	}()
+	select {
+	case <-got:
+		t.Error("Connection accepted while paused.")
+	case <-time.After(5 * delay):
+	}
+	if !srv.Resume() || srv.Resume() {
+		t.Error("Resume should succeed exactly once.")
+	}
+	select {
+	case <-got:
+	case <-time.After(time.Second):
+		t.Error("Connection not accepted after resume.")
+	}
+	if srv.Stats().Accepted != 2 {
+		t.Errorf("Accepted %d connections.", srv.Stats().Accepted)
+	}
+	// stopping a paused server
+	srv.Pause()
+	srv.Stop()
+	<-finish
+	if srv.Paused() {
+		t.Error("Paused after stop.")
+	}
+}
@@ -0,0 +1,313 @@
+package nserv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyProtocol configures parsing of PROXY protocol (versions 1 and 2)
+// headers sent by load balancers in front of the server (see
+// Server.ProxyProtocol). The client's address from the header is then the
+// connection's remote address, as seen by the IP filter, bans, priority lanes,
+// handlers and the access log. Headers are read before the TLS handshake,
+// asynchronously, so that slow connections don't block accepting others.
+type ProxyProtocol struct {
+	// Trusted are the networks (CIDRs or addresses) of the proxies allowed to
+	// send headers. Connections from elsewhere are served as they are. Empty
+	// means that all connections come from trusted proxies.
+	Trusted []string
+	// Required makes connections from trusted proxies without a header
+	// rejected (otherwise they're served with their own addresses).
+	Required bool
+	// Timeout bounds reading the header (default: DefaultProxyHeaderTimeout).
+	Timeout time.Duration
+	// MaxPending bounds the number of connections whose headers are being
+	// read or which wait to be accepted by the server (default:
+	// DefaultProxyMaxPending). No connections are taken off the listen
+	// backlog while the bound is reached, so throttling (see MaxConns) holds.
+	MaxPending int
+}
+
+// Defaults of PROXY protocol parsing, see ProxyProtocol.
+var (
+	DefaultProxyHeaderTimeout = 5 * time.Second
+	DefaultProxyMaxPending    = 128
+)
+
+// proxyV2Signature starts PROXY protocol version 2 headers.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// errNoProxyHeader is returned by readProxyHeader if there's no header.
+var errNoProxyHeader = errors.New("nserv: no PROXY protocol header")
+
+// readProxyHeader reads a PROXY protocol header from r, returns the source
+// and destination addresses (nil if the header doesn't carry them, e.g., for
+// health checks of the proxy itself).
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch b[0] {
+	case 'P':
+		if b, err = r.Peek(6); err != nil || string(b) != "PROXY " {
+			return nil, nil, errNoProxyHeader
+		}
+		return readProxyV1(r)
+	case '\r':
+		if b, err = r.Peek(len(proxyV2Signature)); err != nil || !bytes.Equal(b, proxyV2Signature) {
+			return nil, nil, errNoProxyHeader
+		}
+		return readProxyV2(r)
+	}
+	return nil, nil, errNoProxyHeader
+}
+
+// readProxyV1 reads a version 1 (text) header, e.g.,
+//
+//	PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n
+func readProxyV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < 107 { // the maximum length of the header
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, nil, errors.New("nserv: PROXY v1 header too long")
+	}
+	f := strings.Split(s, " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(f) != 6 || f[1] != "TCP4" && f[1] != "TCP6" {
+		return nil, nil, fmt.Errorf("nserv: malformed PROXY v1 header %q", s)
+	}
+	srcIP, dstIP := net.ParseIP(f[2]), net.ParseIP(f[3])
+	srcPort, err1 := strconv.ParseUint(f[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(f[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil || (srcIP.To4() != nil) != (f[1] == "TCP4") {
+		return nil, nil, fmt.Errorf("nserv: malformed PROXY v1 header %q", s)
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+// readProxyV2 reads a version 2 (binary) header.
+func readProxyV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	hdr := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, nil, err
+	}
+	verCmd, family := hdr[12], hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	if verCmd>>4 != 2 {
+		return nil, nil, fmt.Errorf("nserv: unsupported PROXY protocol version %d", verCmd>>4)
+	}
+	if verCmd&0xf == 0 { // LOCAL: the proxy's own connection
+		return nil, nil, nil
+	}
+	var n int // length of an address
+	switch family >> 4 {
+	case 1: // AF_INET
+		n = net.IPv4len
+	case 2: // AF_INET6
+		n = net.IPv6len
+	default: // AF_UNSPEC, AF_UNIX
+		return nil, nil, nil
+	}
+	if family&0xf != 1 { // not STREAM
+		return nil, nil, nil
+	}
+	if len(body) < 2*n+4 {
+		return nil, nil, errors.New("nserv: PROXY v2 header too short")
+	}
+	src = &net.TCPAddr{IP: net.IP(body[:n]), Port: int(binary.BigEndian.Uint16(body[2*n:]))}
+	dst = &net.TCPAddr{IP: net.IP(body[n : 2*n]), Port: int(binary.BigEndian.Uint16(body[2*n+2:]))}
+	return src, dst, nil
+}
+
+// proxyConn is a connection with the addresses from its PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader // holds the data read past the header
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// proxyListener reads PROXY protocol headers of connections accepted from the
+// underlying listener before passing them on (see ProxyProtocol). At most
+// cap(slots) connections are pending at a time (including the ones waiting to
+// be accepted), the underlying listener isn't accepted from while all slots
+// are taken.
+type proxyListener struct {
+	net.Listener
+	srv       *Server
+	trusted   []*net.IPNet // nil: all
+	required  bool
+	timeout   time.Duration
+	slots     chan struct{}
+	ready     chan net.Conn
+	closed    chan struct{} // closed by Close
+	closeOnce sync.Once
+	done      chan struct{} // closed when acceptLoop returns
+	err       error         // accept error (set before done is closed)
+}
+
+// newProxyListener wraps listn with a proxyListener configured by p.
+func newProxyListener(listn net.Listener, srv *Server, p *ProxyProtocol) (*proxyListener, error) {
+	l := &proxyListener{
+		Listener: listn,
+		srv:      srv,
+		required: p.Required,
+		timeout:  p.Timeout,
+		ready:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, s := range p.Trusted {
+		n, err := parseNetwork(s)
+		if err != nil {
+			return nil, fmt.Errorf("nserv: PROXY protocol: %v", err)
+		}
+		l.trusted = append(l.trusted, n)
+	}
+	if l.timeout <= 0 {
+		l.timeout = DefaultProxyHeaderTimeout
+	}
+	max := p.MaxPending
+	if max <= 0 {
+		max = DefaultProxyMaxPending
+	}
+	l.slots = make(chan struct{}, max)
+	go l.acceptLoop()
+	return l, nil
+}
+
+// acceptLoop accepts connections from the underlying listener (whenever there
+// is a free slot) and passes them on.
+func (l *proxyListener) acceptLoop() {
+	defer close(l.done)
+	for {
+		select {
+		case l.slots <- struct{}{}:
+		case <-l.closed:
+			l.err = net.ErrClosed
+			return
+		}
+		c, err := acceptRetry(l.Listener)
+		if err != nil {
+			<-l.slots
+			l.err = err
+			return
+		}
+		go l.pass(c)
+	}
+}
+
+// pass reads the header of connection c (if it comes from a trusted proxy) and
+// passes it on to Accept, then frees its slot.
+func (l *proxyListener) pass(c net.Conn) {
+	defer func() { <-l.slots }()
+	if l.isTrusted(c.RemoteAddr()) {
+		if c = l.readHeader(c); c == nil {
+			return
+		}
+	}
+	select {
+	case l.ready <- c:
+	case <-l.closed:
+		c.Close()
+	}
+}
+
+// isTrusted tells whether addr is a trusted proxy's address.
+func (l *proxyListener) isTrusted(addr net.Addr) bool {
+	if l.trusted == nil {
+		return true
+	}
+	ip := addrIP(addr)
+	for _, n := range l.trusted {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readHeader reads the header of connection c, returns the connection with
+// the addresses from the header (nil if it's been rejected and closed).
+func (l *proxyListener) readHeader(c net.Conn) net.Conn {
+	c.SetReadDeadline(time.Now().Add(l.timeout))
+	r := bufio.NewReader(c)
+	src, dst, err := readProxyHeader(r)
+	c.SetReadDeadline(time.Time{})
+	if err == errNoProxyHeader && !l.required {
+		err = nil
+	}
+	if err != nil {
+		l.srv.logger().Debug("invalid PROXY protocol header", LogKeyRemote, c.RemoteAddr().String(), LogKeyError, err)
+		c.Close()
+		return nil
+	}
+	pc := &proxyConn{Conn: c, r: r, remote: c.RemoteAddr(), local: c.LocalAddr()}
+	if src != nil {
+		pc.remote, pc.local = src, dst
+	}
+	return pc
+}
+
+// Accept waits for and returns the next connection (with its header read).
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.ready:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// Close closes the underlying listener (connections whose headers are still
+// being read are closed once read).
+func (l *proxyListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// File returns a copy of the underlying listener's file descriptor (for
+// zero-downtime restarts).
+func (l *proxyListener) File() (*os.File, error) {
+	return listenerFile(l.Listener)
+}
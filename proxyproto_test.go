@@ -0,0 +1,220 @@
+package nserv_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"gopkg.in/kornel661/nserv.v0"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// proxyRequest sends a request preceded by header (if any) to the server,
+// returns the response body (the client's address as seen by the handler).
+func proxyRequest(header []byte) (string, error) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Write(append(header, "GET / HTTP/1.0\r\n\r\n"...)); err != nil {
+		return "", err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+// proxyV2Header returns a PROXY protocol version 2 header for a TCP connection
+// from src to dst (IPv4 or IPv6 addresses).
+func proxyV2Header(src, dst *net.TCPAddr) []byte {
+	h := []byte("\r\n\r\n\x00\r\nQUIT\n\x21")
+	var addrs []byte
+	if ip := src.IP.To4(); ip != nil {
+		h = append(h, 0x11)
+		addrs = append(append(addrs, ip...), dst.IP.To4()...)
+	} else {
+		h = append(h, 0x21)
+		addrs = append(append(addrs, src.IP.To16()...), dst.IP.To16()...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(src.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(dst.Port))
+	tlv := []byte{0x04, 0x00, 0x01, 0x00} // PP2_TYPE_NOOP, skipped
+	h = binary.BigEndian.AppendUint16(h, uint16(len(addrs)+len(tlv)))
+	return append(append(h, addrs...), tlv...)
+}
+
+// TestProxyProtocol checks that client addresses are taken from PROXY protocol
+// headers of trusted proxies (also by the IP filter).
+func TestProxyProtocol(t *testing.T) {
+	srv := newServer()
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	})
+	srv.Handler = echo
+	f, err := nserv.NewIPFilter(nil, []string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.IPFilter = f
+	srv.ProxyProtocol = &nserv.ProxyProtocol{Trusted: []string{"127.0.0.0/8", "::1"}, Required: true}
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+		t.Fatal(err)
+	}
+	for header, want := range map[string]string{
+		"PROXY TCP4 198.51.100.7 127.0.0.1 56324 1234\r\n": "198.51.100.7:56324",
+		"PROXY TCP6 2001:db8::7 ::1 4242 1234\r\n":         "[2001:db8::7]:4242",
+		string(proxyV2Header(&net.TCPAddr{IP: net.ParseIP("203.0.113.9"), Port: 1000},
+			&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234})): "203.0.113.9:1000",
+		string(proxyV2Header(&net.TCPAddr{IP: net.ParseIP("2001:db8::9"), Port: 2000},
+			&net.TCPAddr{IP: net.ParseIP("::1"), Port: 1234})): "[2001:db8::9]:2000",
+	} {
+		if got, err := proxyRequest([]byte(header)); err != nil {
+			t.Errorf("%q: %v", header, err)
+		} else if got != want {
+			t.Errorf("%q: the client's address is %s, expected %s.", header, got, want)
+		}
+	}
+	for _, header := range []string{
+		"",                                       // required
+		"PROXY TCP4 198.51.100.7\r\n",            // malformed
+		"PROXY TCP4 192.0.2.1 127.0.0.1 1 2\r\n", // denied by the IP filter
+	} {
+		if _, err := proxyRequest([]byte(header)); err == nil {
+			t.Errorf("%q: connection served.", header)
+		}
+	}
+	if s := srv.Stats(); s.Filtered != 1 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+	srv.Stop()
+	<-finish
+
+	// connections from untrusted sources are served as they are
+	srv = newServer()
+	srv.Handler = echo
+	srv.ProxyProtocol = &nserv.ProxyProtocol{Trusted: []string{"198.51.100.0/24"}, Required: true}
+	finish = make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := proxyRequest(nil); err != nil {
+		t.Error(err)
+	} else if ip := net.ParseIP(hostOf(got)); ip == nil || !ip.IsLoopback() {
+		t.Errorf("Unexpected client's address %s.", got)
+	}
+	// a header of an untrusted source is a malformed request
+	if got, err := proxyRequest([]byte("PROXY TCP4 198.51.100.7 127.0.0.1 56324 1234\r\n")); err == nil && hostOf(got) == "198.51.100.7" {
+		t.Error("Header of an untrusted source used.")
+	}
+	srv.Stop()
+	<-finish
+}
+
+// TestProxyProtocolThrottling checks that waiting connections are bounded by
+// MaxPending, so that the connection limit holds with PROXY protocol on.
+func TestProxyProtocolThrottling(t *testing.T) {
+	srv := newServer()
+	srv.InitialMaxConns = 1
+	release := make(chan struct{})
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			<-release
+		}
+		w.Write([]byte(r.RemoteAddr))
+	})
+	srv.ProxyProtocol = &nserv.ProxyProtocol{MaxPending: 2}
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+		t.Fatal(err)
+	}
+	header := "PROXY TCP4 198.51.100.7 127.0.0.1 56324 1234\r\n"
+	blocked := make(chan error, 1)
+	go func() {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			blocked <- err
+			return
+		}
+		defer c.Close()
+		fmt.Fprintf(c, "%sGET /block HTTP/1.0\r\n\r\n", header)
+		_, err = http.ReadResponse(bufio.NewReader(c), nil)
+		blocked <- err
+	}()
+	for srv.Stats().Active != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	goroutines := runtime.NumGoroutine()
+
+	// the slot is taken, the others wait (mostly in the backlog)
+	conns := make([]net.Conn, 50)
+	for i := range conns {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		fmt.Fprintf(c, "%sGET / HTTP/1.0\r\n\r\n", header)
+		conns[i] = c
+	}
+	time.Sleep(4 * delay)
+	if n := runtime.NumGoroutine() - goroutines; n > 5 {
+		t.Errorf("%d goroutines started for waiting connections.", n)
+	}
+	if s := srv.Stats(); s.Active+s.Idle != 1 || s.Accepted != 1 {
+		t.Errorf("Connection limit exceeded: %+v", s)
+	}
+	close(release)
+	if err := <-blocked; err != nil {
+		t.Error(err)
+	}
+	for _, c := range conns {
+		c.SetDeadline(time.Now().Add(2 * time.Second))
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if hostOf(string(body)) != "198.51.100.7" {
+			t.Errorf("Unexpected client's address %s.", body)
+		}
+	}
+	srv.Stop()
+	<-finish
+}
+
+// hostOf returns the host of address host:port s.
+func hostOf(s string) string {
+	host, _, _ := net.SplitHostPort(s)
+	return host
+}
@@ -0,0 +1,48 @@
+package nserv
+
+import (
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultRecycleJitter is the default Server.RecycleJitter.
+var DefaultRecycleJitter = 0.1
+
+// recycler holds the limits of a connection, see Server.MaxConnAge and
+// Server.MaxRequestsPerConn.
+type recycler struct {
+	deadline    time.Time // the connection is recycled after deadline (if not zero)
+	maxRequests int64     // the connection is recycled after maxRequests requests (if > 0)
+	requests    atomic.Int64
+	recycled    atomic.Bool
+}
+
+// newRecycler returns limits of a new connection for maxAge and maxRequests
+// shortened by a random fraction (up to jitter) of their values.
+func newRecycler(maxAge time.Duration, maxRequests int, jitter float64) *recycler {
+	r := &recycler{}
+	if maxAge > 0 {
+		r.deadline = time.Now().Add(maxAge - time.Duration(rand.Float64()*jitter*float64(maxAge)))
+	}
+	if maxRequests > 0 {
+		r.maxRequests = int64(maxRequests) - int64(rand.Float64()*jitter*float64(maxRequests))
+		if r.maxRequests < 1 {
+			r.maxRequests = 1
+		}
+	}
+	return r
+}
+
+// request records a request responded to via w, asks the client to close the
+// connection if it crossed a limit. Returns true if the connection has been
+// recycled by this request.
+func (r *recycler) request(w http.ResponseWriter) bool {
+	n := r.requests.Add(1)
+	if (r.maxRequests > 0 && n >= r.maxRequests) || (!r.deadline.IsZero() && time.Now().After(r.deadline)) {
+		w.Header().Set("Connection", "close")
+		return r.recycled.CompareAndSwap(false, true)
+	}
+	return false
+}
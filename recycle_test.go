@@ -0,0 +1,113 @@
+package nserv_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"gopkg.in/kornel661/nserv.v0"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestMaxRequestsPerConn checks that connections are recycled after
+// MaxRequestsPerConn requests.
+func TestMaxRequestsPerConn(t *testing.T) {
+	srv := newServer()
+	srv.MaxRequestsPerConn = 3
+	srv.RecycleJitter = -1 // exactly 3 requests
+	srv.Handler = http.HandlerFunc(handler)
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{}}
+	for i := 1; i <= 4; i++ {
+		resp, err := client.Get("http://" + addr + "/recycle")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.Close != (i == 3) {
+			t.Errorf("Request %d: Connection: close is %v.", i, resp.Close)
+		}
+	}
+	if s := srv.Stats(); s.Recycled != 1 || s.Accepted != 2 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+	srv.Stop()
+	<-finish
+}
+
+// TestMaxConnAge checks that keep-alive connections are recycled once older
+// than MaxConnAge, while younger ones are kept.
+func TestMaxConnAge(t *testing.T) {
+	srv := newServer()
+	srv.MaxConnAge = 300 * time.Millisecond
+	srv.RecycleJitter = -1
+	srv.Handler = http.HandlerFunc(handler)
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+		t.Fatal(err)
+	}
+	dial := func() (net.Conn, *bufio.Reader) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, bufio.NewReader(c)
+	}
+	// get sends a keep-alive request over c, returns whether the server asked
+	// to close the connection
+	get := func(c net.Conn, r *bufio.Reader) bool {
+		fmt.Fprintf(c, "GET /age HTTP/1.1\r\nHost: %s\r\n\r\n", addr)
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.Close
+	}
+	old, oldR := dial()
+	defer old.Close()
+	if get(old, oldR) {
+		t.Error("New connection recycled.")
+	}
+	time.Sleep(400 * time.Millisecond)
+	young, youngR := dial()
+	defer young.Close()
+	if get(young, youngR) {
+		t.Error("Young connection recycled.")
+	}
+	if !get(old, oldR) {
+		t.Error("Old connection not recycled.")
+	}
+	if !closedWithin(old, time.Second) {
+		t.Error("Old connection not closed.")
+	}
+	if get(young, youngR) {
+		t.Error("Young connection recycled.")
+	}
+	if s := srv.Stats(); s.Recycled != 1 || s.Accepted != 2 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+	srv.Stop()
+	<-finish
+}
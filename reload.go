@@ -0,0 +1,229 @@
+package nserv
+
+import (
+	"crypto/tls"
+	"io"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+)
+
+// ReloadResult describes the changes of configuration found by Reload. Fields
+// are named as in configuration files (e.g., "limits.max_conns").
+type ReloadResult struct {
+	Applied []string `json:"applied"` // changes applied live
+	Restart []string `json:"restart"` // changes requiring a restart (not applied)
+}
+
+// Reload applies configuration c to the server. Changes that are safe to apply
+// live are applied: the connection limit, TLS certificate, access log, drain
+// policy, keep-alives, maintenance mode, handoff settings and timeouts (for new
+// connections). Other changes (the address, label, expvar name and header size
+// limit) are applied only if the server isn't running, otherwise they're
+// reported as requiring a restart (e.g., ZeroDowntimeRestart).
+//
+// If c is invalid (or its certificate or access log file can't be opened)
+// nothing is applied. See also ReloadConfig and ReloadOnSignal.
+func (srv *Server) Reload(c Config) (ReloadResult, error) {
+	var res ReloadResult
+	if err := c.Validate(); err != nil {
+		return res, err
+	}
+	srv.reloadMu.Lock()
+	defer srv.reloadMu.Unlock()
+	old := srv.currentConfig()
+	if old == nil {
+		old = &Config{}
+	}
+	changed := make(map[string]bool) // changed sections (and top-level fields)
+	var fields []string
+	diffConfig(reflect.ValueOf(old).Elem(), reflect.ValueOf(&c).Elem(), "", &fields)
+	for _, f := range fields {
+		section, _, _ := strings.Cut(f, ".")
+		changed[section] = true
+	}
+
+	// prepare the changes that can fail
+	var cert *certificate
+	state := srv.State()
+	running := state != StateNew && state != StateStopped && state != StateHandedOff
+	// a running server can't switch to TLS
+	useCert := changed["tls"] && c.TLS.CertFile != "" && (srv.certificate.Load() != nil || !running)
+	if useCert {
+		kp, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+		if err != nil {
+			return res, &ConfigError{"tls.cert_file", err}
+		}
+		cert = &certificate{certFile: c.TLS.CertFile, keyFile: c.TLS.KeyFile, cert: &kp}
+	}
+	var al *AccessLog
+	if changed["access_log"] && c.AccessLog.File != "" {
+		var err error
+		if al, err = newAccessLogFromConfig(&c.AccessLog); err != nil {
+			return res, &ConfigError{"access_log.file", err}
+		}
+	}
+
+	srv.mu.Lock()
+	state = srv.State()
+	running = state != StateNew && state != StateStopped && state != StateHandedOff
+	for _, f := range fields {
+		switch section, _, _ := strings.Cut(f, "."); {
+		case running && (section == "tls" && !useCert ||
+			section == "addr" || section == "label" || section == "expvar" ||
+			f == "limits.max_header_bytes"):
+			res.Restart = append(res.Restart, f)
+		default:
+			res.Applied = append(res.Applied, f)
+		}
+	}
+	if !running {
+		srv.Addr, srv.Label, srv.Expvar = c.Addr, c.Label, c.Expvar
+		srv.MaxHeaderBytes = c.Limits.MaxHeaderBytes
+		srv.saneDefaults()
+	}
+	if !running || changed["timeouts"] {
+		srv.setTimeouts(srv.timeoutsOf(&c.Timeouts), running)
+	}
+	if changed["drain"] {
+		srv.DrainPolicy = c.Drain.policy()
+	}
+	var oldLog *AccessLog
+	if changed["access_log"] {
+		oldLog = srv.AccessLog
+		srv.AccessLog = al
+		if running {
+			srv.accessLog.Store(al)
+		}
+	}
+	cfg := c.clone()
+	if cfg.path == "" {
+		cfg.path, cfg.envPrefix = old.path, old.envPrefix
+	}
+	srv.config = cfg
+	srv.mu.Unlock()
+
+	if changed["limits"] {
+		limit := c.Limits.MaxConns
+		if limit == 0 {
+			limit = DefaultMaxConns
+			if srv.defaults != nil {
+				limit = srv.defaults.maxConns
+			}
+		}
+		srv.MaxConns(limit)
+	}
+	if cert != nil {
+		srv.setCertificate(cert)
+	}
+	if changed["keep_alives"] {
+		enabled := c.KeepAlives == nil || *c.KeepAlives
+		if state == StateNew || state == StateServing {
+			srv.SetKeepAlivesEnabled(enabled)
+		} else {
+			srv.noKeepAlive.Store(!enabled) // stopping: applied by Reset
+		}
+	}
+	if changed["maintenance"] {
+		srv.SetMaintenance(c.Maintenance.maintenance()) // validated already
+	}
+	if oldLog != nil {
+		if f := old.AccessLog.File; f != "" && f != "-" { // opened by us
+			// requests in flight might still log to it, stop it first
+			if err := oldLog.Close(); err != nil {
+				srv.logger().Warn("can't flush access log", LogKeyError, err)
+			}
+			if cl, ok := oldLog.Writer.(io.Closer); ok {
+				cl.Close()
+			}
+		} else if err := oldLog.Flush(); err != nil {
+			srv.logger().Warn("can't flush access log", LogKeyError, err)
+		}
+	}
+	if len(fields) > 0 {
+		srv.logger().Info("configuration reloaded", LogKeyApplied, res.Applied, LogKeyRestart, res.Restart)
+	}
+	return res, nil
+}
+
+// diffConfig appends paths of the fields (at field path path) that differ in
+// structs a and b to fields.
+func diffConfig(a, b reflect.Value, path string, fields *[]string) {
+	t := a.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if !t.Field(i).IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if path != "" {
+			name = path + "." + name
+		}
+		fa, fb := a.Field(i), b.Field(i)
+		switch {
+		case fa.Kind() == reflect.Struct:
+			diffConfig(fa, fb, name, fields)
+		case fa.Kind() == reflect.Slice && fa.Len() == 0 && fb.Len() == 0:
+		case !reflect.DeepEqual(fa.Interface(), fb.Interface()):
+			*fields = append(*fields, name)
+		}
+	}
+}
+
+// ReloadConfig reloads the configuration from the file (and environment
+// variables) the server's configuration has been loaded from, see Reload.
+// Returns ErrNoConfigFile if the configuration hasn't been loaded by
+// LoadConfig.
+func (srv *Server) ReloadConfig() (ReloadResult, error) {
+	old := srv.currentConfig()
+	if old == nil || old.path == "" {
+		return ReloadResult{}, ErrNoConfigFile
+	}
+	c, err := LoadConfig(old.path)
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	if old.envPrefix != "" {
+		if err := c.LoadEnv(old.envPrefix); err != nil {
+			return ReloadResult{}, err
+		}
+	}
+	return srv.Reload(*c)
+}
+
+// ReloadOnSignal calls ReloadConfig whenever the process receives one of the
+// signals sigs (SIGHUP if none given), until stop is called. Failures are
+// logged (see Server.Logger).
+func (srv *Server) ReloadOnSignal(sigs ...os.Signal) (stop func()) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGHUP}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ch:
+				if _, err := srv.ReloadConfig(); err != nil {
+					srv.logger().Error("configuration reload failed", LogKeyError, err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
+
+// currentConfig returns the server's configuration (nil if it hasn't been
+// created by NewServerFromConfig or configured by Reload).
+func (srv *Server) currentConfig() *Config {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.config
+}
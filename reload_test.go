@@ -0,0 +1,120 @@
+package nserv_test
+
+import (
+	"context"
+	"errors"
+	"gopkg.in/kornel661/nserv.v0"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestReload checks live reloading of configuration.
+func TestReload(t *testing.T) {
+	path := writeConfig(t, "nserv.conf", testConfig)
+	c, err := nserv.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := nserv.NewServerFromConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Handler = http.HandlerFunc(handler)
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.Run(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+		t.Fatal(err)
+	}
+	getFunc(t, "/reload")
+
+	// a connection accepted before the reload keeps the old timeouts
+	accepted := srv.Stats().Accepted
+	before, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer before.Close()
+	for srv.Stats().Accepted == accepted {
+		time.Sleep(time.Millisecond)
+	}
+	logFile := filepath.Join(t.TempDir(), "access.log")
+	changed := strings.NewReplacer(
+		"max_conns = 7", "max_conns = 9",
+		`read = "30s"`, `read = "300ms"`,
+	).Replace(testConfig) + `
+[access_log]
+file = '` + logFile + `'
+
+[maintenance]
+enabled = true
+`
+	if err := os.WriteFile(path, []byte(changed), 0644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := srv.ReloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(res.Applied)
+	if strings.Join(res.Applied, " ") != "access_log.file limits.max_conns maintenance.enabled timeouts.read" ||
+		len(res.Restart) != 0 {
+		t.Errorf("Unexpected result: %+v", res)
+	}
+	after, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer after.Close()
+	if !closedWithin(after, time.Second) {
+		t.Error("New read timeout not applied to a new connection.")
+	}
+	if closedWithin(before, 500*time.Millisecond) {
+		t.Error("New read timeout applied to an old connection.")
+	}
+	before.Close()
+	if s := srv.Stats(); s.Limit != 9 || !s.Maintenance {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+	resp, err := http.Get("http://" + addr + "/reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Status code in maintenance mode: %d", resp.StatusCode)
+	}
+
+	// invalid configuration isn't applied
+	if err := os.WriteFile(path, []byte("[limits]\nmax_conns = -1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var ce *nserv.ConfigError
+	if _, err := srv.ReloadConfig(); !errors.As(err, &ce) {
+		t.Errorf("Invalid config: %v", err)
+	}
+	if s := srv.Stats(); s.Limit != 9 {
+		t.Errorf("Limit changed to %d.", s.Limit)
+	}
+	srv.Stop()
+	<-finish
+	if srv.ReadTimeout != 300*time.Millisecond {
+		t.Errorf("Read timeout %v after stop.", srv.ReadTimeout)
+	}
+	if data, err := os.ReadFile(logFile); err != nil || !strings.Contains(string(data), `"GET /reload HTTP/1.1" 503`) {
+		t.Errorf("Access log: %s (%v)", data, err)
+	}
+	if _, err := (&nserv.Server{}).ReloadConfig(); !errors.Is(err, nserv.ErrNoConfigFile) {
+		t.Errorf("Reloading without config file: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package nserv_test
+
+import (
+	"context"
+	"errors"
+	"gopkg.in/kornel661/nserv.v0"
+	"net/http"
+	"testing"
+)
+
+// TestReset checks that a stopped server can be served again after Reset.
+func TestReset(t *testing.T) {
+	srv := newServer()
+	srv.Handler = http.HandlerFunc(handler)
+	for i := 0; i < 3; i++ {
+		finish := make(chan struct{})
+		go func() {
+			if err := srv.ListenAndServe(); err != nil {
+				t.Error(err)
+			}
+			close(finish)
+		}()
+		if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+			t.Fatal(err)
+		}
+		if err := srv.Reset(); !errors.Is(err, nserv.ErrServerRunning) {
+			t.Errorf("Reset of a running server returned %v.", err)
+		}
+		getFunc(t, "/reset")
+		srv.Stop()
+		<-finish
+		if err := srv.Reset(); err != nil {
+			t.Fatal(err)
+		}
+		if s := srv.State(); s != nserv.StateNew {
+			t.Errorf("State after Reset: %v", s)
+		}
+	}
+	if s := srv.Stats(); s.Requests != 3 {
+		t.Errorf("Served %d requests.", s.Requests)
+	}
+}
+
+// TestResetKeepAlives checks that Reset restores the keep-alive setting from
+// before Stop.
+func TestResetKeepAlives(t *testing.T) {
+	srv := newServer()
+	srv.Handler = http.HandlerFunc(handler)
+	srv.SetKeepAlivesEnabled(false)
+	for i := 0; i < 2; i++ {
+		finish := make(chan struct{})
+		go func() {
+			if err := srv.ListenAndServe(); err != nil {
+				t.Error(err)
+			}
+			close(finish)
+		}()
+		if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Get("http://" + addr + "/keepalive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if !resp.Close {
+			t.Errorf("Run %d: keep-alives enabled.", i)
+		}
+		srv.Stop()
+		<-finish
+		if err := srv.Reset(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
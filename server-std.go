@@ -29,7 +29,8 @@ func (ln *TCPKeepAliveListener) Accept() (c net.Conn, err error) {
 	return tc, nil
 }
 
-// Some default values set by the ListenAndServe method family. Feel free to modify
+// Some default values set by the ListenAndServe method family (for servers not
+// created by NewServer, which captures its own defaults). Feel free to modify
 // these variables, e.g.,
 //     nserv.DefaultMaxConns = 100
 //     srv.ListenAndServe()
@@ -41,16 +42,34 @@ var (
 	DefaultMaxConns     = 1000             // default MaxConns set by the ListenAndServe methods
 )
 
-// saneDefaults sets some 'sane' default timeouts and limits.
+// saneDefaults sets some 'sane' default timeouts and limits: the ones captured
+// by NewServer or, for servers created otherwise, the Default... variables.
 func (srv *Server) saneDefaults() {
+	d := srv.defaults
+	if d == nil {
+		d = &serverDefaults{
+			readTimeout:  DefaultReadTimeout,
+			writeTimeout: DefaultWriteTimeout,
+			maxConns:     DefaultMaxConns,
+		}
+	}
 	if srv.ReadTimeout == 0 {
-		srv.ReadTimeout = DefaultReadTimeout
+		srv.ReadTimeout = d.readTimeout
+	}
+	if srv.ReadHeaderTimeout == 0 {
+		srv.ReadHeaderTimeout = d.readHeaderTimeout
 	}
 	if srv.WriteTimeout == 0 {
-		srv.WriteTimeout = DefaultWriteTimeout
+		srv.WriteTimeout = d.writeTimeout
+	}
+	if srv.IdleTimeout == 0 {
+		srv.IdleTimeout = d.idleTimeout
+	}
+	if srv.MaxHeaderBytes == 0 {
+		srv.MaxHeaderBytes = d.maxHeaderBytes
 	}
 	if srv.InitialMaxConns == 0 {
-		srv.InitialMaxConns = DefaultMaxConns
+		srv.InitialMaxConns = d.maxConns
 	}
 }
 
@@ -84,6 +103,13 @@ func (srv *Server) ListenAndServe() error {
 //
 // If srv.Addr is blank, ":https" is used.
 //
+// TLS handshakes are performed before connections are throttled, with their
+// own timeout and concurrency limit, see HandshakeTimeout and MaxHandshakes.
+//
+// The certificate can be reloaded from the files while the server is running,
+// see ReloadCertificates. If both file names are empty, the certificate loaded
+// before (e.g., by NewServerFromConfig) is used.
+//
 // If either of ReadTimeout, WriteTimeout or MaxConns is 0, it's going to be set
 // to a 'sane' default value, see the corresponding Default... variable.
 func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
@@ -92,26 +118,44 @@ func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
 	if addr == "" {
 		addr = ":https"
 	}
+	config, err := srv.setupTLS(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	// handshakes are performed by Serve before throttling
+	return srv.serve(&TCPKeepAliveListener{ln.(*net.TCPListener)}, config)
+}
+
+// setupTLS returns the TLS configuration used by ListenAndServeTLS (and
+// ResumeAndServeTLS): a copy of srv.TLSConfig serving the certificate loaded
+// from certFile and keyFile (see ReloadCertificates) with the session ticket
+// keys managed by the server (see SessionTickets).
+func (srv *Server) setupTLS(certFile, keyFile string) (*tls.Config, error) {
 	config := &tls.Config{}
 	if srv.TLSConfig != nil {
-		*config = *srv.TLSConfig
+		config = srv.TLSConfig.Clone()
 	}
 	if config.NextProtos == nil {
 		config.NextProtos = []string{"http/1.1"}
 	}
 
-	var err error
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		return err
+	// the certificate is served via GetCertificate, see ReloadCertificates
+	if certFile != "" || keyFile != "" || srv.certificate.Load() == nil {
+		if err := srv.loadCertificate(certFile, keyFile); err != nil {
+			return nil, err
+		}
 	}
+	config.Certificates = nil
+	config.GetCertificate = srv.getCertificate(config.GetCertificate)
 
-	ln, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
+	if err := srv.setupTicketKeys(config); err != nil {
+		return nil, err
 	}
-
-	tlsListener := tls.NewListener(&TCPKeepAliveListener{ln.(*net.TCPListener)}, config)
-	return srv.Serve(tlsListener)
+	return config, nil
 }
@@ -1,31 +1,93 @@
 package nserv
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"gopkg.in/kornel661/limitnet.v0"
+	"log/slog"
+	"math"
 	"net"
 	"net/http"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Server with graceful exit and throttling.
 //
 // Server is an extension of http.Server from the standard library (its API is
 // a superset of that of http.Server).
+//
+// The server goes through the states StateNew, StateListening, StateServing,
+// StateStopping and StateStopped (or StateHandedOff), see State. All methods
+// have well-defined behavior in every state, none of them blocks until the
+// server is started.
 type Server struct {
-	http.Server                                     // standard net.Server functionality
-	InitialMaxConns int                             // initial limit on simultaneous connections
-	tlist           chan limitnet.ThrottledListener // list for Close(), MaxConns, etc.
-	twlist          chan limitnet.ThrottledListener // list for Wait()
-	initOnce        sync.Once                       // for initialization
-}
+	http.Server                       // standard net.Server functionality
+	InitialMaxConns int               // initial limit on simultaneous connections
+	Admission       *Admission        // optional priority lanes (reserved capacity)
+	Label           string            // name of the server in statistics (default: Addr)
+	Expvar          string            // if set, publish statistics in the expvar map of this name
+	Hooks           Hooks             // optional observer of lifecycle events
+	Logger          *slog.Logger      // optional structured logger (see LogKey... for attribute keys)
+	AccessLog       *AccessLog        // optional access log
+	DrainPolicy     *DrainPolicy      // optional upper bounds on graceful exit
+	SlowClients     *SlowClientPolicy // optional protection against slow clients (slowloris)
+	IPFilter        *IPFilter         // optional allow and deny lists (applied before throttling)
+	BanPolicy       *BanPolicy        // optional temporary banning of abusive clients
+	ProxyProtocol   *ProxyProtocol    // optional parsing of PROXY protocol headers (client addresses)
+	// MaxConnAge and MaxRequestsPerConn limit the lifetime of connections:
+	// once a connection crosses either of them, the response asks the client
+	// to close it (Connection: close), so that keep-alive clients are
+	// rebalanced. The limits of each connection are shortened by a random
+	// fraction of up to RecycleJitter (0: DefaultRecycleJitter, negative: no
+	// jitter), so that connections aren't recycled all at once.
+	MaxConnAge         time.Duration
+	MaxRequestsPerConn int
+	RecycleJitter      float64
+	// HandshakeTimeout and MaxHandshakes bound the TLS handshake phase of
+	// ListenAndServeTLS: handshakes are performed before connections reach
+	// the throttled listener, at most MaxHandshakes at a time (0:
+	// DefaultMaxHandshakes), each within HandshakeTimeout (0:
+	// DefaultHandshakeTimeout). Failures are counted by reason in Stats.
+	// MaxHandshakes also bounds the handshakes performed for classification
+	// by SNI, see Admission.
+	HandshakeTimeout time.Duration
+	MaxHandshakes    int
+	// SessionTickets, if set, makes ListenAndServeTLS manage the TLS session
+	// ticket keys (rotation, passing on to the successor in zero-downtime
+	// restarts).
+	SessionTickets *SessionTicketPolicy
+	// OCSP, if set, makes ListenAndServeTLS staple OCSP responses for the
+	// certificate to TLS handshakes.
+	OCSP *OCSPPolicy
 
-// initialize initializes the server.
-func (srv *Server) initialize() {
-	srv.initOnce.Do(func() {
-		srv.tlist = make(chan limitnet.ThrottledListener, 1)
-		srv.twlist = make(chan limitnet.ThrottledListener, 1)
-	})
+	mu           sync.Mutex                 // guards the fields below and state transitions
+	listener     limitnet.ThrottledListener // the listener (while serving)
+	pauser       *pauseListener             // the innermost listener (while serving), see Pause
+	stateCh      chan struct{}              // closed (and replaced) on state change
+	done         chan struct{}              // closed when Serve finishes
+	stopEarly    bool                       // Stop has been called before Serve
+	handedOff    bool                       // the listener's been handed off to a successor
+	limitSet     bool                       // MaxConns has been called before serving
+	pendingLimit int                        // limit set by MaxConns before serving
+
+	installed   *userHooks                      // user's settings replaced by Serve (if not restored)
+	maintenance atomic.Pointer[maintenanceMode] // maintenance mode (nil if off)
+	noKeepAlive atomic.Bool                     // keep-alives disabled by SetKeepAlivesEnabled (restored by Reset)
+	certificate atomic.Pointer[certificate]     // certificate loaded by ListenAndServeTLS
+	config      *Config                         // configuration (if created by NewServerFromConfig)
+	defaults    *serverDefaults                 // defaults captured by NewServer (nil: Default... variables)
+	accessLog   atomic.Pointer[AccessLog]       // access log in use (AccessLog when serving started, see Reload)
+	reloadMu    sync.Mutex                      // serializes Reload calls
+	bans        banList                         // banned clients, see BanPolicy
+	tickets     ticketKeys                      // session ticket keys, see SessionTickets
+	timeouts    atomic.Pointer[connTimeouts]    // timeouts enforced per connection while serving (nil: by http.Server)
+	ocsp        ocspState                       // OCSP stapling, see OCSP
+	stats       serverStats                     // statistics, see Stats()
+	drain       drainReporter                   // drain progress reports, see Draining()
+	drainState  drainState                      // state of DrainPolicy enforcement
 }
 
 // Serve accepts incoming connections on the Listener listn (wrapped with
@@ -34,60 +96,368 @@ func (srv *Server) initialize() {
 // then call srv.Handler to reply to them.
 // Don't close listn. Rather use srv.Stop() method to exit gracefully.
 // Serve returns on unrecoverable errors and when the server is explicitly
-// stopped by srv.Stop(). By the time Serve returns the listener listn is closed.
+// stopped by srv.Stop() (it returns nil then, or *DrainError if connections
+// had to be cut, see DrainPolicy). By the time Serve returns the listener listn
+// is closed and all connections are terminated.
+//
+// Serve returns ErrServerStopped if the server has already been stopped (or
+// nil if Stop has been called before the server started) and ErrServerRunning
+// if the server is already serving. A stopped server can be served again after
+// calling Reset.
+//
+// If srv.Admission is set, connections are classified and admitted according to
+// the capacity reserved for their classes, see Admission. Accepting can be
+// suspended temporarily, see Pause.
 func (srv *Server) Serve(listn net.Listener) error {
-	srv.initialize()
-	l, ok := listn.(limitnet.ThrottledListener)
-	if !ok {
-		l = limitnet.NewThrottledListener(listn)
-	}
-	l.MaxConns(srv.InitialMaxConns)
-	srv.tlist <- l
-	err := srv.Server.Serve(l)
-	stopped := !srv.Stop()
-	if strings.Contains(err.Error(), "use of closed network connection") && stopped {
-		err = nil // server's been stopped by the user (most probably)
-	}
-	srv.Wait()
+	return srv.serve(listn, nil)
+}
+
+// serve implements Serve. If tlsConfig is set, TLS handshakes of connections
+// accepted on listn are performed before throttling (see HandshakeTimeout).
+func (srv *Server) serve(listn net.Listener, tlsConfig *tls.Config) (err error) {
+	srv.mu.Lock()
+	switch srv.State() {
+	case StateNew:
+	case StateStopped:
+		if srv.stopEarly {
+			srv.stopEarly = false
+			srv.mu.Unlock()
+			listn.Close()
+			return nil
+		}
+		fallthrough
+	case StateStopping, StateHandedOff:
+		srv.mu.Unlock()
+		listn.Close()
+		return ErrServerStopped
+	default:
+		srv.mu.Unlock()
+		listn.Close()
+		return ErrServerRunning
+	}
+	srv.done = make(chan struct{})
+	srv.setState(StateListening)
+	srv.mu.Unlock()
+
+	hooks := srv.hooks()
+	defer func() {
+		srv.mu.Lock()
+		srv.listener, srv.pauser = nil, nil
+		srv.stats.paused.Store(false)
+		if srv.handedOff {
+			srv.setState(StateHandedOff)
+		} else {
+			srv.setState(StateStopped)
+		}
+		close(srv.done)
+		srv.mu.Unlock()
+		hooks.OnStopped(err)
+	}()
+	hooks.OnListen(listn.Addr())
+	srv.stats.admission.Store(nil)
+	srv.stats.paused.Store(false)
+	if tl, ok := listn.(limitnet.ThrottledListener); ok {
+		// throttling is done by the outer listener (below the pause and
+		// admission layers)
+		tl.MaxConns(math.MaxInt32)
+	}
+	pl := newPauseListener(listn)
+	listn = pl
+	if srv.ProxyProtocol != nil {
+		pp, err := newProxyListener(listn, srv, srv.ProxyProtocol)
+		if err != nil {
+			listn.Close()
+			return err
+		}
+		listn = pp
+	}
+	if srv.IPFilter != nil {
+		listn = &filterListener{Listener: listn, allowed: srv.IPFilter.allowedAddr, onReject: func(c net.Conn) {
+			srv.stats.filtered.Add(1)
+			hooks.OnConnRejected(c.RemoteAddr())
+		}}
+	}
+	srv.bans.policy.Store(nil)
+	if srv.BanPolicy != nil {
+		srv.bans.policy.Store(srv.BanPolicy.withDefaults())
+		listn = &filterListener{Listener: listn, allowed: srv.bans.allowedAddr, onReject: func(c net.Conn) {
+			srv.stats.banned.Add(1)
+			hooks.OnConnRejected(c.RemoteAddr())
+		}}
+	}
+	srv.stats.handshakes.Store(nil)
+	if tlsConfig != nil {
+		hl := newHandshakeListener(listn, srv, tlsConfig)
+		srv.stats.handshakes.Store(hl)
+		listn = hl
+	}
+	if srv.Admission != nil {
+		al, err := newAdmissionListener(listn, srv.Admission, srv.InitialMaxConns, srv.MaxHandshakes, func(c net.Conn) {
+			hooks.OnConnRejected(c.RemoteAddr())
+			srv.banEvent(c.RemoteAddr(), banRejected)
+		})
+		if err != nil {
+			listn.Close()
+			return err
+		}
+		srv.stats.admission.Store(al)
+		listn = al
+	}
+	l := limitnet.NewThrottledListener(&tlsMarker{listn})
+	srv.stats.start.Store(time.Now().UnixNano())
+	if srv.Expvar != "" {
+		srv.publishExpvar()
+	}
+	// track connections and requests (restore user's settings on return)
+	connState, connContext, handler := srv.ConnState, srv.ConnContext, srv.Handler
+	if srv.installed != nil { // left installed by the previous run
+		connState, connContext, handler = srv.installed.connState, srv.installed.connContext, srv.installed.handler
+	}
+	restore := true
+	defer func() {
+		if restore {
+			srv.ConnState, srv.ConnContext, srv.Handler = connState, connContext, handler
+			srv.installed = nil
+			srv.mu.Lock()
+			srv.uninstallTimeouts()
+			srv.mu.Unlock()
+		} else {
+			srv.installed = &userHooks{connState, connContext, handler}
+		}
+	}()
+	srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		ctx = context.WithValue(ctx, connKey{}, c)
+		if connContext != nil {
+			ctx = connContext(ctx, c)
+		}
+		return ctx
+	}
+	srv.ConnState = func(c net.Conn, state http.ConnState) {
+		srv.stats.conns.track(c, state)
+		if sc, ok := c.(*statsConn); ok && sc.slow != nil {
+			trackSlow(sc, state)
+		}
+		if sc, ok := c.(*statsConn); ok && sc.deadlines != nil {
+			sc.deadlines.track(state)
+		}
+		if state == http.StateClosed && srv.State() == StateServing {
+			if sc, ok := c.(*statsConn); ok && sc.tls != nil && !sc.tls.ConnectionState().HandshakeComplete {
+				srv.banEvent(c.RemoteAddr(), banHandshake)
+			}
+		}
+		if srv.Logger != nil && state != http.StateActive && state != http.StateIdle {
+			srv.logSaturation(srv.stats.conns.open())
+		}
+		if connState != nil {
+			connState(c, state)
+		}
+	}
+	srv.Handler = srv.instrument(handler)
+
+	srv.mu.Lock()
+	srv.accessLog.Store(srv.AccessLog)
+	limit := srv.InitialMaxConns
+	if srv.limitSet {
+		limit, srv.limitSet = srv.pendingLimit, false
+	}
+	srv.setLimit(l, limit)
+	serving := srv.State() == StateListening // not stopped in the meantime
+	if serving {
+		srv.listener, srv.pauser = l, pl
+		srv.setState(StateServing)
+	}
+	srv.mu.Unlock()
+	if serving {
+		hooks.OnServe()
+		sl := &statsListener{Listener: l, srv: srv, maxAge: srv.MaxConnAge, maxRequests: srv.MaxRequestsPerConn, jitter: srv.RecycleJitter}
+		if sl.jitter == 0 {
+			sl.jitter = DefaultRecycleJitter
+		} else if sl.jitter < 0 {
+			sl.jitter = 0
+		}
+		done := make(chan struct{})
+		defer close(done)
+		if p := srv.SlowClients; p != nil {
+			sl.slow = p
+			go srv.checkSlowClients(p, done)
+		}
+		if p := srv.bans.policy.Load(); p != nil {
+			go srv.pruneBans(p.Window, done)
+		}
+		if p := srv.SessionTickets; p != nil && tlsConfig != nil {
+			go srv.rotateTicketKeys(p, done)
+		}
+		if p := srv.OCSP; p != nil && tlsConfig != nil {
+			go srv.ocspFetcher(p, done)
+		}
+		err = srv.Server.Serve(sl)
+	} else {
+		l.Close()
+	}
+	if !srv.Stop() || errors.Is(err, http.ErrServerClosed) {
+		// the listener's been closed by srv.Stop (or srv.Shutdown/Close)
+		err = nil
+	}
+	srv.drainConns(l)
+	if cut := srv.drainState.cut.Load(); cut > 0 {
+		// handlers of the cut connections might be still running, leave
+		// the hooks installed
+		restore = false
+		if err == nil {
+			err = &DrainError{Cut: int(cut)}
+		}
+	} else {
+		srv.stats.conns.wait() // all ConnState calls have returned
+	}
+	if tlsConfig != nil {
+		srv.tickets.detach(tlsConfig)
+	}
+	if al := srv.accessLog.Load(); al != nil {
+		if err := al.Flush(); err != nil {
+			srv.logger().Warn("can't flush access log", LogKeyError, err)
+		}
+	}
 	return err
 }
 
-// Wait returns only when the server is closed and all connections terminated.
+// userHooks holds the user's settings of http.Server replaced by Serve.
+type userHooks struct {
+	connState   func(net.Conn, http.ConnState)
+	connContext func(context.Context, net.Conn) context.Context
+	handler     http.Handler
+}
+
+// setLimit sets the throttling limit of listener l to n (srv.mu held).
+func (srv *Server) setLimit(l limitnet.ThrottledListener, n int) (free int) {
+	if al := srv.stats.admission.Load(); al != nil {
+		al.setLimit(n)
+	}
+	srv.stats.limit.Store(int64(n))
+	return l.MaxConns(n)
+}
+
+// instrument wraps handler h (http.DefaultServeMux if nil) so that requests are
+// counted, their durations recorded and logged to the access log. In
+// maintenance mode it answers requests with the maintenance response instead. It sets r.TLS
+// for requests received over TLS (http.Server doesn't recognize TLS connections
+// wrapped by the throttled listener).
+func (srv *Server) instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.stats.requests.Add(1)
+		start := time.Now()
+		if c := connFromContext(r.Context()); r.TLS == nil && c != nil && c.tls != nil {
+			cs := c.tls.ConnectionState()
+			r.TLS = &cs
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		if c := connFromContext(r.Context()); c != nil && c.slow != nil {
+			c.slow.headerSince.Store(0) // headers received
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = &meteredBody{r.Body, &c.slow.upload}
+			}
+		}
+		if c := connFromContext(r.Context()); c != nil && c.recycle != nil && c.recycle.request(w) {
+			srv.stats.recycled.Add(1)
+		}
+		if mm := srv.maintenance.Load(); mm != nil && !mm.allows(r) {
+			srv.stats.maintenance.Add(1)
+			mm.ServeHTTP(sw, r)
+		} else if h == nil {
+			http.DefaultServeMux.ServeHTTP(sw, r)
+		} else {
+			h.ServeHTTP(sw, r)
+		}
+		if !sw.hijacked {
+			if sw.code == 0 {
+				sw.code = http.StatusOK
+			}
+			srv.stats.durations.observe(sw.code, time.Since(start))
+			srv.banRequest(r, sw.code)
+			if al := srv.accessLog.Load(); al != nil {
+				al.log(newAccessLogEntry(r, sw, start))
+			}
+		}
+	})
+}
+
+// Wait returns only when the server is stopped and all connections terminated
+// (i.e., when Serve is about to return). Returns immediately if the server
+// hasn't been started.
 func (srv *Server) Wait() {
-	srv.initialize()
-	if tl, ok := <-srv.twlist; ok {
-		tl.Wait()
-		close(srv.twlist)
+	srv.mu.Lock()
+	done := srv.done
+	srv.mu.Unlock()
+	if done != nil {
+		<-done
 	}
 }
 
 // Stop gracefully stops a running server. Returns false if server had already
 // been stopped before. Can return before the server is actually shut down.
 //
-// Fragile if you tinker with the server's listener.
+// If the server hasn't been started yet, it's marked as stopped (and a
+// subsequent call to Serve returns nil right away).
 func (srv *Server) Stop() bool {
-	srv.SetKeepAlivesEnabled(false) // do it early (as if it matters)
-	srv.initialize()
-	if tl, ok := <-srv.tlist; ok {
-		tl.Close()
-		close(srv.tlist)
-		srv.twlist <- tl
-		return true
-	}
-	return false
+	srv.Server.SetKeepAlivesEnabled(false) // do it early (as if it matters)
+	srv.mu.Lock()
+	var l limitnet.ThrottledListener
+	switch srv.State() {
+	case StateNew:
+		srv.stopEarly = true
+		srv.setState(StateStopped)
+	case StateListening:
+		srv.setState(StateStopping) // Serve won't start accepting
+	case StateServing:
+		l = srv.listener
+		srv.setState(StateStopping)
+	default:
+		srv.mu.Unlock()
+		return false
+	}
+	srv.mu.Unlock()
+	srv.hooks().OnStopRequested()
+	if l != nil {
+		l.Close()
+	}
+	return true
 }
 
 // MaxConns sets new throttling limit (max number of simultaneous connections),
 // returns number of free slots for incoming connections. For n < 0 doesn't change
 // the limit. See limitnet.ThrottledListener for more detailed description.
 //
-// Won't return until srv.Serve is called.
+// If the server isn't serving yet, MaxConns sets the initial limit (overriding
+// srv.InitialMaxConns). Returns 0 (and doesn't change anything) if the server
+// has been stopped.
 func (srv *Server) MaxConns(n int) (free int) {
-	srv.initialize()
-	if tl, ok := <-srv.tlist; ok {
-		free = tl.MaxConns(n)
-		srv.tlist <- tl
-		return
+	srv.mu.Lock()
+	old := int(srv.stats.limit.Load())
+	switch srv.State() {
+	case StateNew, StateListening:
+		if !srv.limitSet {
+			old = srv.InitialMaxConns
+		}
+		if n >= 0 {
+			srv.limitSet, srv.pendingLimit = true, n
+			srv.stats.limit.Store(int64(n))
+		}
+		free = srv.InitialMaxConns
+		if srv.limitSet {
+			free = srv.pendingLimit
+		}
+	case StateServing:
+		if n >= 0 {
+			free = srv.setLimit(srv.listener, n)
+		} else {
+			free = srv.listener.MaxConns(n)
+		}
+	default:
+		srv.mu.Unlock()
+		return 0
+	}
+	srv.mu.Unlock()
+	if n >= 0 && n != old {
+		srv.hooks().OnLimitChanged(old, n)
 	}
-	return 0
+	return free
 }
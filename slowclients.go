@@ -0,0 +1,195 @@
+package nserv
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SlowClientPolicy protects the server against slow clients holding
+// connections (and throttled slots) for a long time, e.g., slowloris attacks
+// (see Server.SlowClients). Offending connections are closed and counted in
+// Stats. Zero value of a field disables the corresponding check.
+type SlowClientPolicy struct {
+	// HeaderTimeout is the time a client has to send request headers
+	// (measured from accepting the connection or, for subsequent requests,
+	// from receiving the first byte of the request). Connections are checked
+	// every HeaderTimeout (or Window/5 if shorter), so an offending one is
+	// closed within twice HeaderTimeout.
+	HeaderTimeout time.Duration
+	// MinUploadRate is the minimum rate (bytes per second) at which a client
+	// has to send the request body while the handler is reading it.
+	MinUploadRate int64
+	// MinDownloadRate is the minimum rate (bytes per second) at which a
+	// client has to receive the response while the server is sending it.
+	MinDownloadRate int64
+	// Window is the sliding window the rates are measured over (default:
+	// DefaultSlowClientWindow). A rate is checked only if the transfer has
+	// been blocked on the client for at least half of the window.
+	Window time.Duration
+}
+
+// DefaultSlowClientWindow is the default SlowClientPolicy.Window.
+var DefaultSlowClientWindow = 10 * time.Second
+
+// slowSamples is the number of samples of transfer meters in a window.
+const slowSamples = 5
+
+// slowConn holds the state of a connection checked by SlowClientPolicy.
+type slowConn struct {
+	headerSince atomic.Int64 // when reading of request headers started (unix nanoseconds), 0 if not reading
+	idle        atomic.Bool  // waiting for the next request
+	upload      rateMeter    // request body reads
+	download    rateMeter    // connection writes
+}
+
+// rateMeter measures transfer rate over a sliding window, only counting the
+// time spent blocked in transfers.
+type rateMeter struct {
+	mu      sync.Mutex
+	bytes   int64         // total number of bytes transferred
+	blocked time.Duration // total time blocked in (finished) transfers
+	pending time.Time     // start of the transfer in progress (zero if none)
+	samples [slowSamples + 1]rateSample
+	next    int // index of the next sample
+	count   int // number of recorded samples
+}
+
+// rateSample holds cumulative values of rateMeter.
+type rateSample struct {
+	bytes   int64
+	blocked time.Duration
+}
+
+// begin marks the start of a transfer.
+func (m *rateMeter) begin() {
+	m.mu.Lock()
+	m.pending = time.Now()
+	m.mu.Unlock()
+}
+
+// end marks the end of a transfer of n bytes.
+func (m *rateMeter) end(n int) {
+	m.mu.Lock()
+	m.blocked += time.Since(m.pending)
+	m.pending = time.Time{}
+	m.bytes += int64(n)
+	m.mu.Unlock()
+}
+
+// sample records a sample, returns the number of bytes transferred and the time
+// blocked within the window (ok is false until the window is full).
+func (m *rateMeter) sample(now time.Time) (bytes int64, blocked time.Duration, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cur := rateSample{m.bytes, m.blocked}
+	if !m.pending.IsZero() {
+		cur.blocked += now.Sub(m.pending)
+	}
+	m.samples[m.next] = cur
+	m.next = (m.next + 1) % len(m.samples)
+	if m.count < len(m.samples) {
+		m.count++
+		return 0, 0, false
+	}
+	oldest := m.samples[m.next] // the window's start
+	return cur.bytes - oldest.bytes, cur.blocked - oldest.blocked, true
+}
+
+// tooSlow tells if the rate measured by m is below rate (bytes per second).
+func (m *rateMeter) tooSlow(now time.Time, window time.Duration, rate int64) bool {
+	bytes, blocked, ok := m.sample(now)
+	return ok && rate > 0 && blocked >= window/2 && float64(bytes) < float64(rate)*blocked.Seconds()
+}
+
+// meteredBody measures the rate at which the request body is received.
+type meteredBody struct {
+	io.ReadCloser
+	m *rateMeter
+}
+
+func (b *meteredBody) Read(p []byte) (n int, err error) {
+	b.m.begin()
+	n, err = b.ReadCloser.Read(p)
+	b.m.end(n)
+	return
+}
+
+// trackSlow updates the header timer of connection c on its state change. New
+// connections wait for headers since accepted, idle ones since the first byte
+// of the next request is read (see statsConn.Read).
+func trackSlow(c *statsConn, state http.ConnState) {
+	if state == http.StateIdle { // subject to IdleTimeout
+		c.slow.headerSince.Store(0)
+		c.slow.idle.Store(true)
+	}
+}
+
+// read records that n bytes have been read from the connection.
+func (sc *slowConn) read(n int) {
+	if n > 0 && sc.idle.CompareAndSwap(true, false) {
+		sc.headerSince.Store(time.Now().UnixNano())
+	}
+}
+
+// checkSlowClients closes connections violating policy p until done is closed.
+// Rates are sampled every window/slowSamples, header timeouts are checked at
+// least every p.HeaderTimeout.
+func (srv *Server) checkSlowClients(p *SlowClientPolicy, done <-chan struct{}) {
+	window := p.Window
+	if window <= 0 {
+		window = DefaultSlowClientWindow
+	}
+	period, tick := window/slowSamples, window/slowSamples
+	if p.HeaderTimeout > 0 && p.HeaderTimeout < tick {
+		tick = p.HeaderTimeout
+	}
+	nextSample := time.Now().Add(period)
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	t := &srv.stats.conns
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			rates := !now.Before(nextSample) // time to sample the rates
+			for !nextSample.After(now) {
+				nextSample = nextSample.Add(period)
+			}
+			var slow []*statsConn
+			var reasons []string
+			t.mu.Lock()
+			for c := range t.conns {
+				sc, ok := c.(*statsConn)
+				if !ok || sc.slow == nil {
+					continue
+				}
+				reason := ""
+				since := sc.slow.headerSince.Load()
+				switch {
+				case p.HeaderTimeout > 0 && since != 0 && now.Sub(time.Unix(0, since)) > p.HeaderTimeout:
+					reason = "headers"
+					srv.stats.slowHeaders.Add(1)
+				case rates && sc.slow.upload.tooSlow(now, window, p.MinUploadRate):
+					reason = "upload"
+					srv.stats.slowUploads.Add(1)
+				case rates && sc.slow.download.tooSlow(now, window, p.MinDownloadRate):
+					reason = "download"
+					srv.stats.slowDownloads.Add(1)
+				default:
+					continue
+				}
+				slow, reasons = append(slow, sc), append(reasons, reason)
+			}
+			t.mu.Unlock()
+			for i, c := range slow {
+				srv.logger().Warn("slow client closed", LogKeyRemote, c.RemoteAddr().String(), LogKeyReason, reasons[i])
+				c.Close()
+				srv.banEvent(c.RemoteAddr(), banSlow)
+			}
+		}
+	}
+}
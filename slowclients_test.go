@@ -0,0 +1,125 @@
+package nserv_test
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/kornel661/nserv.v0"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// closedWithin tells if connection c gets closed by the server within d.
+func closedWithin(c net.Conn, d time.Duration) bool {
+	c.SetReadDeadline(time.Now().Add(d))
+	_, err := io.Copy(ioutil.Discard, c)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return true
+}
+
+// TestSlowClients checks that slow clients are disconnected.
+func TestSlowClients(t *testing.T) {
+	srv := newServer()
+	srv.SlowClients = &nserv.SlowClientPolicy{
+		HeaderTimeout: 200 * time.Millisecond,
+		MinUploadRate: 1000,
+		Window:        500 * time.Millisecond,
+	}
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		handler(w, r)
+	})
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+		t.Fatal(err)
+	}
+	getFunc(t, "/fast")
+
+	// slow headers
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(c, "GET /slow HTTP/1.1\r\nHost: %s\r\n", addr)
+	if !closedWithin(c, 2*time.Second) {
+		t.Error("Slow headers not detected.")
+	}
+	c.Close()
+
+	// slow upload
+	c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(c, "POST /slow HTTP/1.1\r\nHost: %s\r\nContent-Length: 1000\r\n\r\n", addr)
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(50 * time.Millisecond):
+				if _, err := c.Write([]byte("x")); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	if !closedWithin(c, 3*time.Second) {
+		t.Error("Slow upload not detected.")
+	}
+	close(stop)
+	c.Close()
+
+	if s := srv.Stats(); s.SlowHeaders != 1 || s.SlowUploads != 1 || s.SlowDownloads != 0 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+	srv.Stop()
+	<-finish
+}
+
+// TestSlowHeadersTimeout checks that slow headers are detected within twice
+// HeaderTimeout, even if it's much shorter than the rate window.
+func TestSlowHeadersTimeout(t *testing.T) {
+	srv := newServer()
+	srv.SlowClients = &nserv.SlowClientPolicy{HeaderTimeout: 100 * time.Millisecond} // default window
+	srv.Handler = http.HandlerFunc(handler)
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	fmt.Fprintf(c, "GET /slow HTTP/1.1\r\nHost: %s\r\n", addr)
+	if !closedWithin(c, time.Second) {
+		t.Error("Slow headers not detected.")
+	} else if d := time.Since(start); d > 300*time.Millisecond {
+		t.Errorf("Slow headers detected after %v.", d)
+	}
+	c.Close()
+	if s := srv.Stats(); s.SlowHeaders != 1 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+	srv.Stop()
+	<-finish
+}
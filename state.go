@@ -0,0 +1,110 @@
+package nserv
+
+import (
+	"context"
+)
+
+// State is the lifecycle state of a Server.
+type State int32
+
+// Lifecycle states of a Server.
+const (
+	StateNew       State = iota // the server hasn't been started yet
+	StateListening              // Serve has been called, the server prepares its listener
+	StateServing                // the server accepts connections
+	StateStopping               // the server has been stopped, waits for active connections
+	StateStopped                // the server has been stopped, all connections are closed
+	StateHandedOff              // the server has handed off its listener (see ZeroDowntimeRestart) and finished
+)
+
+var stateNames = [...]string{
+	StateNew:       "new",
+	StateListening: "listening",
+	StateServing:   "serving",
+	StateStopping:  "stopping",
+	StateStopped:   "stopped",
+	StateHandedOff: "handed-off",
+}
+
+func (s State) String() string {
+	if s >= 0 && int(s) < len(stateNames) {
+		return stateNames[s]
+	}
+	return "unknown"
+}
+
+// State returns the current lifecycle state of the server. It never blocks.
+func (srv *Server) State() State {
+	return State(srv.stats.state.Load())
+}
+
+// setState changes the state of the server to s (srv.mu held).
+func (srv *Server) setState(s State) {
+	srv.stats.state.Store(int32(s))
+	if srv.stateCh != nil {
+		close(srv.stateCh)
+		srv.stateCh = nil
+	}
+}
+
+// stateChanged returns a channel closed on the next state change (srv.mu held).
+func (srv *Server) stateChanged() <-chan struct{} {
+	if srv.stateCh == nil {
+		srv.stateCh = make(chan struct{})
+	}
+	return srv.stateCh
+}
+
+// WaitForState waits until the server reaches state s. It returns ctx.Err() if
+// ctx is done first and ErrServerStopped if the server has finished (is in
+// StateStopped or StateHandedOff) in a state different from s.
+func (srv *Server) WaitForState(ctx context.Context, s State) error {
+	for {
+		srv.mu.Lock()
+		cur := srv.State()
+		changed := srv.stateChanged()
+		srv.mu.Unlock()
+		switch {
+		case cur == s:
+			return nil
+		case cur == StateStopped || cur == StateHandedOff:
+			return ErrServerStopped
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Reset resets a stopped (or handed-off) server to StateNew, so that it can be
+// served again. Statistics counters keep accumulating. Keep-alives (disabled
+// by Stop) are restored to the setting of SetKeepAlivesEnabled. Returns
+// ErrServerRunning if the server hasn't finished yet (it's a no-op for a new
+// server).
+func (srv *Server) Reset() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	switch srv.State() {
+	case StateNew:
+		return nil
+	case StateStopped, StateHandedOff:
+	default:
+		return ErrServerRunning
+	}
+	srv.stopEarly, srv.handedOff = false, false
+	srv.done = nil
+	srv.drain.reset()
+	srv.Server.SetKeepAlivesEnabled(!srv.noKeepAlive.Load())
+	srv.setState(StateNew)
+	return nil
+}
+
+// SetKeepAlivesEnabled controls whether HTTP keep-alives are enabled (see
+// http.Server.SetKeepAlivesEnabled). Stop disables them regardless, the
+// setting is restored by Reset.
+func (srv *Server) SetKeepAlivesEnabled(v bool) {
+	srv.noKeepAlive.Store(!v)
+	srv.Server.SetKeepAlivesEnabled(v)
+}
@@ -0,0 +1,70 @@
+package nserv_test
+
+import (
+	"context"
+	"errors"
+	"gopkg.in/kornel661/limitnet.v0"
+	"gopkg.in/kornel661/nserv.v0"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestState checks the lifecycle state machine and that methods don't block
+// before the server is started.
+func TestState(t *testing.T) {
+	srv := newServer()
+	if s := srv.State(); s != nserv.StateNew {
+		t.Errorf("Initial state: %v", s)
+	}
+	// none of these block
+	if free := srv.MaxConns(5); free != 5 {
+		t.Errorf("MaxConns before Serve returned %d.", free)
+	}
+	err := srv.OperateOnListener(func(limitnet.ThrottledListener) error { return nil })
+	if !errors.Is(err, nserv.ErrServerNotRunning) {
+		t.Errorf("OperateOnListener before Serve returned %v.", err)
+	}
+	srv.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), delay)
+	if err := srv.WaitForState(ctx, nserv.StateServing); err != context.DeadlineExceeded {
+		t.Errorf("WaitForState returned %v.", err)
+	}
+	cancel()
+
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+		t.Fatal(err)
+	}
+	if s := srv.Stats(); s.Limit != 5 {
+		t.Errorf("Limit set before Serve not applied: %d", s.Limit)
+	}
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Serve(l); !errors.Is(err, nserv.ErrServerRunning) {
+		t.Errorf("Serving twice returned %v.", err)
+	}
+	srv.Stop()
+	if err := srv.WaitForState(context.Background(), nserv.StateStopped); err != nil {
+		t.Error(err)
+	}
+	select {
+	case <-finish:
+	case <-time.After(time.Second):
+		t.Error("Serve hasn't returned.")
+	}
+	if err := srv.WaitForState(context.Background(), nserv.StateServing); !errors.Is(err, nserv.ErrServerStopped) {
+		t.Errorf("WaitForState on a stopped server returned %v.", err)
+	}
+	if free := srv.MaxConns(10); free != 0 {
+		t.Errorf("MaxConns on a stopped server returned %d.", free)
+	}
+}
@@ -0,0 +1,423 @@
+package nserv
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats holds statistics of a Server, see Server.Stats.
+type Stats struct {
+	State                State         // lifecycle state
+	Paused               bool          // whether accepting is paused (see Server.Pause)
+	Maintenance          bool          // whether the server is in maintenance mode (see Server.SetMaintenance)
+	Limit                int           // current throttling limit
+	Active               int           // number of connections serving requests (incl. new ones)
+	Idle                 int           // number of idle (keep-alive) connections
+	Accepted             uint64        // total number of accepted connections
+	Rejected             uint64        // total number of connections rejected by admission control
+	Queued               int           // number of connections queued by admission control
+	Filtered             uint64        // total number of connections rejected by the IP filter
+	Banned               uint64        // total number of connections rejected due to bans (see BanPolicy)
+	Handshaking          int           // number of connections in the TLS handshake phase (see Server.MaxHandshakes)
+	AcceptErrors         uint64        // total number of accept errors
+	Requests             uint64        // total number of requests served
+	MaintenanceResponses uint64        // total number of requests answered in maintenance mode
+	SlowHeaders          uint64        // connections closed for sending headers too slowly (see SlowClientPolicy)
+	SlowUploads          uint64        // connections closed for sending request bodies too slowly
+	SlowDownloads        uint64        // connections closed for receiving responses too slowly
+	Recycled             uint64        // connections recycled (see Server.MaxConnAge and MaxRequestsPerConn)
+	BytesIn              uint64        // total number of bytes read from connections
+	BytesOut             uint64        // total number of bytes written to connections
+	Handoffs             uint64        // number of zero-downtime restarts performed
+	Uptime               time.Duration // time since the server started serving
+
+	// HandshakeFailures holds total numbers of failed TLS handshakes by
+	// reason (see Server.HandshakeTimeout).
+	HandshakeFailures map[string]uint64
+}
+
+// Stats returns current statistics of the server. It's safe to call Stats
+// concurrently from any goroutine, at any time (it never blocks on the
+// server's state).
+func (srv *Server) Stats() Stats {
+	st := &srv.stats
+	s := Stats{
+		State:                State(st.state.Load()),
+		Paused:               st.paused.Load(),
+		Maintenance:          srv.maintenance.Load() != nil,
+		MaintenanceResponses: st.maintenance.Load(),
+		SlowHeaders:          st.slowHeaders.Load(),
+		SlowUploads:          st.slowUploads.Load(),
+		SlowDownloads:        st.slowDownloads.Load(),
+		Recycled:             st.recycled.Load(),
+		Filtered:             st.filtered.Load(),
+		Banned:               st.banned.Load(),
+		Handshaking:          int(st.handshaking.Load()),
+		HandshakeFailures:    make(map[string]uint64, handshakeReasons),
+		Limit:                int(st.limit.Load()),
+		Accepted:             st.accepted.Load(),
+		AcceptErrors:         st.acceptErrors.Load(),
+		Requests:             st.requests.Load(),
+		BytesIn:              st.bytesIn.Load(),
+		BytesOut:             st.bytesOut.Load(),
+		Handoffs:             st.handoffs.Load(),
+	}
+	if start := st.start.Load(); start != 0 {
+		s.Uptime = time.Since(time.Unix(0, start))
+	}
+	for i := range st.handshakeFailures {
+		s.HandshakeFailures[handshakeReasonNames[i]] = st.handshakeFailures[i].Load()
+	}
+	s.Active, s.Idle = st.conns.counts()
+	if al := st.admission.Load(); al != nil {
+		s.Queued, s.Rejected = al.counts()
+	}
+	return s
+}
+
+// serverStats holds the counters Server.Stats reports.
+type serverStats struct {
+	state         atomic.Int32
+	paused        atomic.Bool
+	limit         atomic.Int64
+	start         atomic.Int64 // start time (unix nanoseconds)
+	accepted      atomic.Uint64
+	acceptErrors  atomic.Uint64
+	requests      atomic.Uint64
+	maintenance   atomic.Uint64 // requests answered in maintenance mode
+	slowHeaders   atomic.Uint64
+	slowUploads   atomic.Uint64
+	slowDownloads atomic.Uint64
+	recycled      atomic.Uint64
+	filtered      atomic.Uint64 // connections rejected by the IP filter
+	banned        atomic.Uint64 // connections rejected due to bans
+	handshaking   atomic.Int64  // connections in the TLS handshake phase
+	bytesIn       atomic.Uint64
+	bytesOut      atomic.Uint64
+	handoffs      atomic.Uint64
+	saturated     atomic.Bool // whether the throttling limit has been reached
+	durations     requestDurations
+	admission     atomic.Pointer[admissionListener]
+	handshakes    atomic.Pointer[handshakeListener]
+	conns         connTracker
+
+	handshakeFailures [handshakeReasons]atomic.Uint64 // failed TLS handshakes by reason
+}
+
+// connTracker keeps track of states of the server's connections (fed by
+// http.Server.ConnState).
+type connTracker struct {
+	mu    sync.Mutex
+	cond  *sync.Cond // signaled when the last connection is closed
+	conns map[net.Conn]*connInfo
+
+	hijacked map[net.Conn]struct{} // hijacked connections until closed, see DrainKill
+}
+
+// connInfo describes a tracked connection.
+type connInfo struct {
+	state   http.ConnState
+	created time.Time // when the connection was accepted
+	changed time.Time // when the state last changed
+}
+
+// track records state change of connection c.
+func (t *connTracker) track(c net.Conn, state http.ConnState) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch state {
+	case http.StateNew:
+		if t.conns == nil {
+			t.conns = make(map[net.Conn]*connInfo)
+		}
+		t.conns[c] = &connInfo{state: state, created: now, changed: now}
+	case http.StateClosed, http.StateHijacked:
+		delete(t.conns, c)
+		if state == http.StateHijacked {
+			if t.hijacked == nil {
+				t.hijacked = make(map[net.Conn]struct{})
+			}
+			t.hijacked[c] = struct{}{}
+		}
+		if len(t.conns) == 0 && t.cond != nil {
+			t.cond.Broadcast()
+		}
+	default:
+		if ci, ok := t.conns[c]; ok {
+			ci.state = state
+			ci.changed = now
+		}
+	}
+}
+
+// closed records that connection c (possibly hijacked) has been closed.
+func (t *connTracker) closed(c net.Conn) {
+	t.mu.Lock()
+	delete(t.hijacked, c)
+	t.mu.Unlock()
+}
+
+// wait waits until all tracked connections are closed (or hijacked).
+func (t *connTracker) wait() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cond == nil {
+		t.cond = sync.NewCond(&t.mu)
+	}
+	for len(t.conns) > 0 {
+		t.cond.Wait()
+	}
+}
+
+// open returns the number of open connections.
+func (t *connTracker) open() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// counts returns the number of active (incl. new) and idle connections.
+func (t *connTracker) counts() (active, idle int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, ci := range t.conns {
+		if ci.state == http.StateIdle {
+			idle++
+		} else {
+			active++
+		}
+	}
+	return
+}
+
+// statsListener counts accepted connections, accept errors and transferred
+// bytes.
+type statsListener struct {
+	net.Listener
+	srv  *Server
+	slow *SlowClientPolicy // if set, connections are checked for slow clients
+
+	maxAge      time.Duration // see Server.MaxConnAge
+	maxRequests int           // see Server.MaxRequestsPerConn
+	jitter      float64       // see Server.RecycleJitter
+}
+
+// Accept accepts a connection and wraps it so that transferred bytes are
+// counted.
+func (l *statsListener) Accept() (net.Conn, error) {
+	st := &l.srv.stats
+	c, err := l.Listener.Accept()
+	if err != nil {
+		if State(st.state.Load()) == StateServing {
+			st.acceptErrors.Add(1)
+			l.srv.logAcceptError(err)
+		}
+		return nil, err
+	}
+	id := st.accepted.Add(1)
+	sc := &statsConn{Conn: c, stats: st, id: id}
+	if a, ok := c.LocalAddr().(*tlsAddr); ok {
+		sc.tls = a.conn
+	}
+	if l.slow != nil {
+		sc.slow = &slowConn{}
+		sc.slow.headerSince.Store(time.Now().UnixNano())
+	}
+	if l.maxAge > 0 || l.maxRequests > 0 {
+		sc.recycle = newRecycler(l.maxAge, l.maxRequests, l.jitter)
+	}
+	if t := l.srv.timeouts.Load(); t != nil {
+		sc.deadlines = newConnDeadlines(sc, t)
+	}
+	return sc, nil
+}
+
+// statsConn counts bytes read from and written to the connection.
+type statsConn struct {
+	net.Conn
+	stats   *serverStats
+	id      uint64    // connection ID, see ConnID
+	slow    *slowConn // see SlowClientPolicy (nil if not checked)
+	recycle *recycler // connection's lifetime limits (nil if unlimited)
+	tls     *tls.Conn // the TLS connection beneath (nil if not TLS)
+
+	deadlines *connDeadlines // enforced timeouts (nil if enforced by http.Server)
+}
+
+func (c *statsConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.stats.bytesIn.Add(uint64(n))
+	if c.slow != nil {
+		c.slow.read(n)
+	}
+	if c.deadlines != nil {
+		c.deadlines.read(n)
+	}
+	return
+}
+
+// Close closes the connection (and stops tracking it if hijacked).
+func (c *statsConn) Close() error {
+	c.stats.conns.closed(c)
+	return c.Conn.Close()
+}
+
+// LocalAddr returns the local address (without the mark of tlsMarker).
+func (c *statsConn) LocalAddr() net.Addr {
+	if a, ok := c.Conn.LocalAddr().(*tlsAddr); ok {
+		return a.Addr
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *statsConn) SetDeadline(t time.Time) error {
+	if c.deadlines != nil && c.deadlines.set(true, true, t) {
+		return nil
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *statsConn) SetReadDeadline(t time.Time) error {
+	if c.deadlines != nil && c.deadlines.set(true, false, t) {
+		return nil
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *statsConn) SetWriteDeadline(t time.Time) error {
+	if c.deadlines != nil && c.deadlines.set(false, true, t) {
+		return nil
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *statsConn) Write(b []byte) (n int, err error) {
+	if c.slow != nil {
+		c.slow.download.begin()
+		defer func() { c.slow.download.end(n) }()
+	}
+	n, err = c.Conn.Write(b)
+	c.stats.bytesOut.Add(uint64(n))
+	return
+}
+
+// durationBuckets are upper bounds (in seconds) of the buckets of request
+// duration histograms.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram is a cumulative histogram of request durations.
+type histogram struct {
+	buckets []uint64 // counts of observations <= durationBuckets[i]
+	count   uint64
+	sum     float64 // in seconds
+}
+
+// requestDurations holds histograms of request durations by status code.
+type requestDurations struct {
+	mu     sync.Mutex
+	byCode map[int]*histogram
+}
+
+// observe records a request with status code which took d to serve.
+func (rd *requestDurations) observe(code int, d time.Duration) {
+	secs := d.Seconds()
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if rd.byCode == nil {
+		rd.byCode = make(map[int]*histogram)
+	}
+	h, ok := rd.byCode[code]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(durationBuckets))}
+		rd.byCode[code] = h
+	}
+	for i, le := range durationBuckets {
+		if secs <= le {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += secs
+}
+
+// snapshot returns a copy of the histograms.
+func (rd *requestDurations) snapshot() map[int]histogram {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	m := make(map[int]histogram, len(rd.byCode))
+	for code, h := range rd.byCode {
+		m[code] = histogram{
+			buckets: append([]uint64(nil), h.buckets...),
+			count:   h.count,
+			sum:     h.sum,
+		}
+	}
+	return m
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	code     int
+	bytes    int64 // number of bytes of the body written
+	hijacked bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher.
+func (w *statusWriter) Flush() {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("nserv: ResponseWriter doesn't support hijacking")
+	}
+	c, rw, err := h.Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return c, rw, err
+}
+
+// Unwrap returns the underlying ResponseWriter (see http.ResponseController).
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// label returns the name identifying the server in statistics.
+func (srv *Server) label() string {
+	if srv.Label != "" {
+		return srv.Label
+	}
+	return srv.Addr
+}
@@ -0,0 +1,46 @@
+package nserv_test
+
+import (
+	"gopkg.in/kornel661/nserv.v0"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestStats checks statistics reported by the server.
+func TestStats(t *testing.T) {
+	srv := newServer()
+	srv.InitialMaxConns = 5
+	srv.Handler = http.HandlerFunc(handler)
+	// doesn't block before Serve
+	if s := srv.Stats(); s.State != nserv.StateNew {
+		t.Errorf("State before Serve: %v", s.State)
+	}
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	time.Sleep(delay)
+	getFunc(t, "/stats")
+	s := srv.Stats()
+	if s.State != nserv.StateServing {
+		t.Errorf("State while serving: %v", s.State)
+	}
+	if s.Limit != 5 || s.Accepted != 1 || s.Requests != 1 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+	if s.BytesIn == 0 || s.BytesOut == 0 || s.Uptime == 0 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+	if s.Active+s.Idle != 1 {
+		t.Errorf("Expected one connection, got %d active, %d idle.", s.Active, s.Idle)
+	}
+	srv.Stop()
+	<-finish
+	if s := srv.Stats(); s.State != nserv.StateStopped || s.Active+s.Idle != 0 {
+		t.Errorf("Unexpected stats after stop: %+v", s)
+	}
+}
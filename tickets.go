@@ -0,0 +1,221 @@
+package nserv
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SessionTicketPolicy configures management of TLS session ticket keys by
+// ListenAndServeTLS and ResumeAndServeTLS (see Server.SessionTickets). Every
+// Rotation a new key starts to be used for issuing tickets, the previous
+// Keys-1 ones are still accepted. The keys are passed on to the successor in
+// a zero-downtime restart (through an inherited pipe, never in the
+// environment, see HandoffEnv), so that clients can resume their TLS sessions
+// across restarts.
+//
+// If KeyFile is set, the keys are loaded from the file (and reloaded every
+// Rotation) instead, e.g., to share them among a fleet of servers. The file
+// holds base64-encoded 32-byte keys, one per line, the first one is used for
+// issuing tickets; empty lines and lines starting with # are ignored.
+type SessionTicketPolicy struct {
+	Rotation time.Duration // rotation period (default: DefaultTicketKeyRotation)
+	Keys     int           // number of accepted keys (default: DefaultTicketKeys)
+	KeyFile  string        // optional file with the keys
+}
+
+// Defaults of SessionTicketPolicy.
+var (
+	DefaultTicketKeyRotation = 12 * time.Hour
+	DefaultTicketKeys        = 3
+)
+
+// rotation returns the rotation period.
+func (p *SessionTicketPolicy) rotation() time.Duration {
+	if p.Rotation <= 0 {
+		return DefaultTicketKeyRotation
+	}
+	return p.Rotation
+}
+
+// ticketKeys holds the session ticket keys managed by the server.
+type ticketKeys struct {
+	mu      sync.Mutex
+	keys    [][32]byte  // the first one is used for issuing tickets
+	rotated time.Time   // when the keys have been rotated last
+	config  *tls.Config // configuration the keys are set on (nil if not serving TLS)
+}
+
+// ticketState holds the session ticket keys passed on in a zero-downtime
+// restart.
+type ticketState struct {
+	Keys    [][]byte  `json:"keys"`
+	Rotated time.Time `json:"rotated"`
+}
+
+// setupTicketKeys sets the session ticket keys on config (if managed by the
+// server). The keys are created (or loaded from the file) unless there are
+// some already, e.g., passed on by the predecessor.
+func (srv *Server) setupTicketKeys(config *tls.Config) error {
+	p := srv.SessionTickets
+	if p == nil {
+		return nil
+	}
+	t := &srv.tickets
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.config = config
+	if p.KeyFile != "" || len(t.keys) == 0 {
+		return t.rotate(p)
+	}
+	config.SetSessionTicketKeys(t.keys)
+	return nil
+}
+
+// rotate rotates (or reloads) the keys according to policy p (t.mu held).
+func (t *ticketKeys) rotate(p *SessionTicketPolicy) error {
+	var keys [][32]byte
+	if p.KeyFile != "" {
+		var err error
+		if keys, err = loadTicketKeys(p.KeyFile); err != nil {
+			return err
+		}
+	} else {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		n := p.Keys
+		if n <= 0 {
+			n = DefaultTicketKeys
+		}
+		keys = append([][32]byte{key}, t.keys...)
+		if len(keys) > n {
+			keys = keys[:n]
+		}
+	}
+	t.keys, t.rotated = keys, time.Now()
+	if t.config != nil {
+		t.config.SetSessionTicketKeys(keys)
+	}
+	return nil
+}
+
+// loadTicketKeys loads session ticket keys from file path.
+func loadTicketKeys(path string) ([][32]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys [][32]byte
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("nserv: %s:%d: expected a base64-encoded 32-byte key", path, line)
+		}
+		keys = append(keys, [32]byte(b))
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("nserv: %s: no session ticket keys", path)
+	}
+	return keys, nil
+}
+
+// RotateTicketKeys rotates the session ticket keys right away (or reloads them
+// from SessionTicketPolicy.KeyFile). If it fails, the current keys are kept.
+// Returns ErrNoTicketKeys if the server doesn't serve TLS with managed keys
+// (see SessionTickets).
+func (srv *Server) RotateTicketKeys() error {
+	p := srv.SessionTickets
+	t := &srv.tickets
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p == nil || t.config == nil {
+		return ErrNoTicketKeys
+	}
+	if err := t.rotate(p); err != nil {
+		srv.logger().Error("can't rotate session ticket keys", LogKeyError, err)
+		return err
+	}
+	srv.logger().Info("session ticket keys rotated")
+	return nil
+}
+
+// rotateTicketKeys rotates the session ticket keys according to policy p
+// until done is closed.
+func (srv *Server) rotateTicketKeys(p *SessionTicketPolicy, done <-chan struct{}) {
+	t := &srv.tickets
+	t.mu.Lock()
+	next := t.rotated.Add(p.rotation())
+	t.mu.Unlock()
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if srv.RotateTicketKeys() != nil {
+			next = time.Now().Add(p.rotation()) // keep the current keys meanwhile
+			continue
+		}
+		t.mu.Lock()
+		next = t.rotated.Add(p.rotation())
+		t.mu.Unlock()
+	}
+}
+
+// detach stops setting the keys on config (when the server stops serving).
+func (t *ticketKeys) detach(config *tls.Config) {
+	t.mu.Lock()
+	if t.config == config {
+		t.config = nil
+	}
+	t.mu.Unlock()
+}
+
+// state returns the keys to be passed on in a zero-downtime restart (nil if
+// there aren't any).
+func (t *ticketKeys) state() *ticketState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.keys) == 0 {
+		return nil
+	}
+	s := &ticketState{Rotated: t.rotated}
+	for _, key := range t.keys {
+		s.Keys = append(s.Keys, append([]byte(nil), key[:]...))
+	}
+	return s
+}
+
+// restore restores the keys passed on by the predecessor.
+func (t *ticketKeys) restore(s *ticketState) error {
+	if s == nil {
+		return nil
+	}
+	var keys [][32]byte
+	for _, key := range s.Keys {
+		if len(key) != 32 {
+			return fmt.Errorf("nserv: invalid session ticket key")
+		}
+		keys = append(keys, [32]byte(key))
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.keys, t.rotated = keys, s.Rotated
+	return nil
+}
@@ -0,0 +1,146 @@
+package nserv_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"gopkg.in/kornel661/nserv.v0"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSessionTickets checks that TLS sessions are resumed with the keys
+// managed by the server, and that rotation takes effect.
+func TestSessionTickets(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	ticketFile := filepath.Join(t.TempDir(), "tickets")
+	writeKey := func() {
+		key := make([]byte, 32)
+		rand.Read(key)
+		data := "# current key\n" + base64.StdEncoding.EncodeToString(key) + "\n"
+		if err := os.WriteFile(ticketFile, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeKey()
+	srv := newServer()
+	srv.Handler = http.HandlerFunc(handler)
+	srv.SessionTickets = &nserv.SessionTicketPolicy{KeyFile: ticketFile, Rotation: time.Hour}
+	if err := srv.RotateTicketKeys(); !errors.Is(err, nserv.ErrNoTicketKeys) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServeTLS(certFile, keyFile); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		},
+		DisableKeepAlives: true,
+	}}
+	resumed := func() bool {
+		resp, err := client.Get("https://" + addr + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		ioutil.ReadAll(resp.Body)
+		return resp.TLS.DidResume
+	}
+	if resumed() {
+		t.Error("The first session resumed.")
+	}
+	if !resumed() {
+		t.Error("Session not resumed.")
+	}
+	writeKey()
+	if err := srv.RotateTicketKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if resumed() {
+		t.Error("Session resumed with a ticket of a dropped key.")
+	}
+	if !resumed() {
+		t.Error("Session not resumed after rotation.")
+	}
+	os.WriteFile(ticketFile, []byte("invalid\n"), 0600)
+	if err := srv.RotateTicketKeys(); err == nil {
+		t.Error("Invalid key file accepted.")
+	}
+	if !resumed() {
+		t.Error("Keys changed by a failed rotation.")
+	}
+	srv.Stop()
+	<-finish
+}
+
+// TestSessionTicketsHandoff checks that sessions are resumed by the successor
+// with the keys passed on in a zero-downtime restart.
+func TestSessionTicketsHandoff(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	serve := func(srv *nserv.Server) chan struct{} {
+		srv.Handler = http.HandlerFunc(handler)
+		srv.SessionTickets = &nserv.SessionTicketPolicy{Rotation: time.Hour}
+		finish := make(chan struct{})
+		go func() {
+			if err := srv.ListenAndServeTLS(certFile, keyFile); err != nil {
+				t.Error(err)
+			}
+			close(finish)
+		}()
+		if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+			t.Fatal(err)
+		}
+		return finish
+	}
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		},
+		DisableKeepAlives: true,
+	}}
+	resumed := func() bool {
+		resp, err := client.Get("https://" + addr + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		ioutil.ReadAll(resp.Body)
+		return resp.TLS.DidResume
+	}
+
+	srv := newServer()
+	finish := serve(srv)
+	if resumed() {
+		t.Error("The first session resumed.")
+	}
+	handOff(t, srv, finish, "https", certFile, keyFile)
+	if !resumed() {
+		t.Error("Session not resumed by the successor.")
+	}
+	stopSuccessor(t, client, "https")
+
+	// without the handoff the keys are new
+	srv = newServer()
+	finish = serve(srv)
+	if resumed() {
+		t.Error("Session resumed without the keys passed on.")
+	}
+	srv.Stop()
+	<-finish
+}
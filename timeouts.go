@@ -0,0 +1,199 @@
+package nserv
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connTimeouts are the timeouts of http.Server (ReadTimeout, ReadHeaderTimeout,
+// WriteTimeout and IdleTimeout). http.Server's settings mustn't be modified
+// while it's running, so once Reload changes the timeouts of a running server,
+// the server enforces them itself on the connections accepted afterwards (see
+// connDeadlines). Connections accepted before are left to http.Server, as are
+// all connections of a server whose timeouts haven't been reloaded.
+type connTimeouts struct {
+	read, readHeader, write, idle time.Duration
+}
+
+// header returns the timeout for reading request headers.
+func (t *connTimeouts) header() time.Duration {
+	if t.readHeader > 0 {
+		return t.readHeader
+	}
+	return t.read
+}
+
+// idleTime returns the timeout for waiting for the next request.
+func (t *connTimeouts) idleTime() time.Duration {
+	if t.idle > 0 {
+		return t.idle
+	}
+	return t.read
+}
+
+// timeoutsOf returns the timeouts configured by c (the server's defaults for
+// the unset ones, as in saneDefaults).
+func (srv *Server) timeoutsOf(c *TimeoutsConfig) *connTimeouts {
+	t := &connTimeouts{
+		read:       time.Duration(c.Read),
+		readHeader: time.Duration(c.ReadHeader),
+		write:      time.Duration(c.Write),
+		idle:       time.Duration(c.Idle),
+	}
+	d := srv.defaults
+	if d == nil {
+		d = &serverDefaults{readTimeout: DefaultReadTimeout, writeTimeout: DefaultWriteTimeout}
+	}
+	if t.read == 0 {
+		t.read = d.readTimeout
+	}
+	if t.readHeader == 0 {
+		t.readHeader = d.readHeaderTimeout
+	}
+	if t.write == 0 {
+		t.write = d.writeTimeout
+	}
+	if t.idle == 0 {
+		t.idle = d.idleTimeout
+	}
+	return t
+}
+
+// uninstallTimeouts hands the reloaded timeouts (if any) back to http.Server
+// once it doesn't serve any connection (srv.mu held).
+func (srv *Server) uninstallTimeouts() {
+	if t := srv.timeouts.Swap(nil); t != nil {
+		srv.ReadTimeout, srv.ReadHeaderTimeout, srv.WriteTimeout, srv.IdleTimeout = t.read, t.readHeader, t.write, t.idle
+	}
+}
+
+// setTimeouts sets the timeouts (srv.mu held): for new connections if the
+// server is running, on http.Server otherwise.
+func (srv *Server) setTimeouts(t *connTimeouts, running bool) {
+	if running {
+		srv.timeouts.Store(t)
+		return
+	}
+	srv.timeouts.Store(nil)
+	srv.ReadTimeout, srv.ReadHeaderTimeout, srv.WriteTimeout, srv.IdleTimeout = t.read, t.readHeader, t.write, t.idle
+}
+
+// Phases of a connection, see connDeadlines.
+const (
+	phaseRequest = iota // reading the request headers
+	phaseActive         // serving the request
+	phaseIdle           // waiting for the next request
+	phaseDone           // hijacked or closed
+)
+
+// connDeadlines enforces timeouts on a connection as http.Server does. The
+// deadlines http.Server sets while reading requests and between them (derived
+// from its own, possibly outdated, settings) are ignored. While a request is
+// served, deadlines set on the connection (e.g., by a handler via
+// http.ResponseController or by the drain policy) take precedence until the
+// next request. Once hijacked, the connection's deadlines are left to the
+// handler.
+type connDeadlines struct {
+	c    *statsConn
+	t    *connTimeouts
+	idle atomic.Bool // waiting for the next request
+
+	mu                  sync.Mutex
+	phase               int
+	start               time.Time // when the current request started
+	ownRead, ownWrite   time.Time // deadlines due to the timeouts
+	userRead, userWrite time.Time // deadlines set explicitly (zero if none)
+}
+
+// newConnDeadlines starts enforcing timeouts t on connection c.
+func newConnDeadlines(c *statsConn, t *connTimeouts) *connDeadlines {
+	d := &connDeadlines{c: c, t: t}
+	d.mu.Lock()
+	d.request(time.Now())
+	d.mu.Unlock()
+	return d
+}
+
+// request starts a request at now (d.mu held).
+func (d *connDeadlines) request(now time.Time) {
+	d.phase, d.start = phaseRequest, now
+	d.ownRead, d.ownWrite = after(now, d.t.header()), time.Time{}
+	d.apply()
+}
+
+// after returns the deadline timeout after now (zero if timeout is zero).
+func after(now time.Time, timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return now.Add(timeout)
+}
+
+// apply sets the effective deadlines on the connection (d.mu held).
+func (d *connDeadlines) apply() {
+	read, write := d.ownRead, d.ownWrite
+	if !d.userRead.IsZero() {
+		read = d.userRead
+	}
+	if !d.userWrite.IsZero() {
+		write = d.userWrite
+	}
+	d.c.Conn.SetReadDeadline(read)
+	d.c.Conn.SetWriteDeadline(write)
+}
+
+// read records that n bytes have been read from the connection (the next
+// request starts with its first byte).
+func (d *connDeadlines) read(n int) {
+	if n > 0 && d.idle.CompareAndSwap(true, false) {
+		d.mu.Lock()
+		if d.phase == phaseIdle {
+			d.request(time.Now())
+		}
+		d.mu.Unlock()
+	}
+}
+
+// track updates the deadlines on the connection's state change.
+func (d *connDeadlines) track(state http.ConnState) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch state {
+	case http.StateActive: // the headers have been read
+		d.phase = phaseActive
+		d.ownRead, d.ownWrite = after(d.start, d.t.read), after(time.Now(), d.t.write)
+	case http.StateIdle:
+		d.phase = phaseIdle
+		d.ownRead, d.ownWrite = after(time.Now(), d.t.idleTime()), time.Time{}
+		d.userRead, d.userWrite = time.Time{}, time.Time{}
+		d.idle.Store(true)
+	case http.StateHijacked, http.StateClosed:
+		d.phase = phaseDone
+		d.ownRead, d.ownWrite = time.Time{}, time.Time{}
+	default:
+		return
+	}
+	d.apply()
+}
+
+// set handles a deadline set on the connection, returns whether it's been
+// handled (otherwise it's to be set on the connection directly).
+func (d *connDeadlines) set(read, write bool, t time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch d.phase {
+	case phaseDone:
+		return false
+	case phaseActive:
+		if read {
+			d.userRead = t
+		}
+		if write {
+			d.userWrite = t
+		}
+		d.apply()
+	}
+	return true
+}
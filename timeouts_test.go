@@ -0,0 +1,109 @@
+package nserv_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"gopkg.in/kornel661/nserv.v0"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// checkTimeouts checks whether the header, idle and write timeouts of new
+// connections are short (a fraction of a second) or long.
+func checkTimeouts(t *testing.T, phase string, short bool) {
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	// headers not finished
+	c := dial()
+	fmt.Fprintf(c, "GET /headers HTTP/1.1\r\nHost: %s\r\n", addr)
+	if closedWithin(c, 500*time.Millisecond) != short {
+		t.Errorf("%s: header timeout not short (%v).", phase, short)
+	}
+	c.Close()
+
+	// idle after a request
+	c = dial()
+	fmt.Fprintf(c, "GET /idle HTTP/1.1\r\nHost: %s\r\n\r\n", addr)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if resp, err := http.ReadResponse(bufio.NewReader(c), nil); err != nil {
+		t.Errorf("%s: %v", phase, err)
+	} else {
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if closedWithin(c, 500*time.Millisecond) != short {
+		t.Errorf("%s: idle timeout not short (%v).", phase, short)
+	}
+	c.Close()
+
+	// response written too late
+	c = dial()
+	fmt.Fprintf(c, "GET /slow HTTP/1.1\r\nHost: %s\r\n\r\n", addr)
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := http.ReadResponse(bufio.NewReader(c), nil); (err != nil) != short {
+		t.Errorf("%s: write timeout not short (%v): %v", phase, short, err)
+	}
+	c.Close()
+}
+
+// TestTimeouts checks the header, idle and write timeouts of new connections
+// before and after they're reloaded (then they're enforced by the server
+// instead of http.Server).
+func TestTimeouts(t *testing.T) {
+	short, long := 150*time.Millisecond, 3*time.Second
+	srv := newServer()
+	srv.ReadTimeout = 5 * time.Second
+	srv.ReadHeaderTimeout, srv.IdleTimeout, srv.WriteTimeout = short, short, short
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(400 * time.Millisecond)
+		}
+		handler(w, r)
+	})
+	finish := make(chan struct{})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			t.Error(err)
+		}
+		close(finish)
+	}()
+	if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+		t.Fatal(err)
+	}
+	checkTimeouts(t, "before reload", true)
+
+	reload := func(d time.Duration) {
+		c := nserv.Config{Timeouts: nserv.TimeoutsConfig{
+			Read:       nserv.Duration(5 * time.Second),
+			ReadHeader: nserv.Duration(d),
+			Write:      nserv.Duration(d),
+			Idle:       nserv.Duration(d),
+		}}
+		if res, err := srv.Reload(c); err != nil || len(res.Restart) != 0 {
+			t.Fatalf("Reload: %+v (%v)", res, err)
+		}
+	}
+	// http.Server's own (short) deadlines don't apply
+	reload(long)
+	checkTimeouts(t, "reloaded (long)", false)
+	reload(short)
+	checkTimeouts(t, "reloaded (short)", true)
+
+	// handed back to http.Server on exit
+	reload(long)
+	srv.Stop()
+	<-finish
+	if srv.ReadHeaderTimeout != long || srv.WriteTimeout != long || srv.IdleTimeout != long {
+		t.Errorf("Timeouts after stop: %v %v %v", srv.ReadHeaderTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+}
@@ -1,12 +1,30 @@
 package nserv
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
 	"gopkg.in/kornel661/limitnet.v0"
+	"io"
+	"net"
 	"os"
+	"strconv"
+	"strings"
 )
 
+// HandoffEnv is the name of the environment variable carrying the number of
+// the file descriptor (a pipe inherited by the successor in a zero-downtime
+// restart) the server's runtime settings (e.g., maintenance mode, bans,
+// session ticket keys) are read from. The settings themselves never appear in
+// the environment; the successor reads them once and closes the pipe.
+const HandoffEnv = "NSERV_HANDOFF"
+
+// handoffState holds the runtime settings passed on in a zero-downtime restart.
+type handoffState struct {
+	Maintenance *Maintenance `json:"maintenance,omitempty"`
+	Bans        []Ban        `json:"bans,omitempty"`
+	TicketKeys  *ticketState `json:"ticket_keys,omitempty"`
+}
+
 // InitializeZeroDowntime sets up the command-line flags used by this package for
 // supporting zero-downtime restarts. See also: limitnet.InitializeZeroDowntime().
 // You need to execute flag.Parse() after InitializeZeroDowntime() for it to work.
@@ -27,70 +45,194 @@ func CanResume() bool {
 // First, limitnet.RetrieveListeners() is called to retrieve a listener. Next,
 // if either of srv.ReadTimeout, srv.WriteTimeout or srv.MaxConns is 0, it's
 // going to be set to a 'sane' default value, see the corresponding Default...
-// variables. Finally, srv.Serve method is invoked with the retrieved listener
-// as its argument.
+// variables. The runtime settings passed on by the predecessor (see HandoffEnv)
+// are restored. Finally, srv.Serve method is invoked with the retrieved
+// listener as its argument.
 func (srv *Server) ResumeAndServe() error {
-	listeners, err := limitnet.RetrieveListeners()
+	l, err := srv.resume()
 	if err != nil {
 		return err
 	}
+	return srv.Serve(l)
+}
+
+// ResumeAndServeTLS is like ResumeAndServe, but it serves TLS connections as
+// ListenAndServeTLS does (with the certificate loaded from certFile and
+// keyFile). Session ticket keys passed on by the predecessor are used, see
+// SessionTickets.
+func (srv *Server) ResumeAndServeTLS(certFile, keyFile string) error {
+	l, err := srv.resume()
+	if err != nil {
+		return err
+	}
+	config, err := srv.setupTLS(certFile, keyFile)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	return srv.serve(l, config)
+}
+
+// resume retrieves the inherited listener and restores the runtime settings
+// passed on by the predecessor.
+func (srv *Server) resume() (net.Listener, error) {
+	listeners, err := limitnet.RetrieveListeners()
+	if err != nil {
+		return nil, err
+	}
 	if len(listeners) != 1 {
 		for _, l := range listeners {
 			l.Close()
 		}
-		return fmt.Errorf("Inherited %d listeners instead of 1.", len(listeners))
+		return nil, fmt.Errorf("%w: inherited %d listeners instead of 1", ErrListenerCountMismatch, len(listeners))
 	}
 	srv.saneDefaults()
-	return srv.Serve(listeners[0])
+	if err := srv.restoreHandoff(); err != nil {
+		// serve anyway, the predecessor has handed off already
+		srv.logger().Error("can't restore handoff state", LogKeyError, err)
+	}
+	return listeners[0], nil
 }
 
 // ZeroDowntimeRestart shuts down the server and launches binary named the same
 // as currently executing program with command line arguments args. The newly
-// executed program inherits the file descriptor the srv server used.
+// executed program inherits the file descriptor the srv server used. The server
+// ends up in StateHandedOff (instead of StateStopped).
+//
+// If args are empty and the server has been created by NewServerFromConfig,
+// Config.Handoff.Args are used.
 //
 // Error behavior similar to Server.OperateOnListener or due to command
-// execution error.
+// execution error. The returned error wraps ErrHandoffFailed (and the cause).
 func (srv *Server) ZeroDowntimeRestart(args ...string) error {
+	if c := srv.currentConfig(); len(args) == 0 && c != nil {
+		args = c.Handoff.Args
+	}
+	hooks := srv.hooks()
+	hooks.OnHandoffStarted(args)
 	err := srv.OperateOnListener(func(l limitnet.ThrottledListener) error {
 		// prepare the command to be executed
-		cmd, err := limitnet.PrepareCmd("", args, nil, l)
+		cmd, err := limitnet.PrepareCmd("", args, handoffEnv(), l)
 		if err != nil {
 			return err
 		}
+		state, err := srv.handoffPipe()
+		if err != nil {
+			cmd.ExtraFiles[0].Close()
+			return err
+		}
+		cmd.ExtraFiles = append(cmd.ExtraFiles, state)
+		cmd.Env = append(cmd.Env, HandoffEnv+"="+strconv.Itoa(2+len(cmd.ExtraFiles)))
 		// start the command, return error
 		err = cmd.Start()
-		cmd.ExtraFiles[0].Close() // close unused file
+		cmd.ExtraFiles[0].Close() // close unused files
+		state.Close()
+		if err == nil {
+			srv.handedOff = true
+			srv.watchChild(cmd)
+		}
 		return err
 	})
 	if err == nil {
+		srv.stats.handoffs.Add(1)
 		srv.Stop()
+	} else {
+		err = fmt.Errorf("%w: %w", ErrHandoffFailed, err)
 	}
+	hooks.OnHandoffCompleted(err)
 	return err
 }
 
+// handoffEnv returns the environment of the successor (the current one
+// without HandoffEnv).
+func handoffEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, HandoffEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// handoffPipe returns the read end of a pipe the server's runtime settings are
+// written to (in the background, the pipe might not hold them all until the
+// successor reads them). The writer gives up when the read end is closed in
+// all processes.
+func (srv *Server) handoffPipe() (*os.File, error) {
+	data, err := json.Marshal(&handoffState{
+		Maintenance: srv.Maintenance(),
+		Bans:        srv.Bans(),
+		TicketKeys:  srv.tickets.state(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if _, err := w.Write(data); err != nil {
+			srv.logger().Warn("can't pass on handoff state", LogKeyError, err)
+		}
+		w.Close()
+	}()
+	return r, nil
+}
+
+// restoreHandoff restores the runtime settings passed on by the predecessor
+// (if any) from the file descriptor named in HandoffEnv.
+func (srv *Server) restoreHandoff() error {
+	v, ok := os.LookupEnv(HandoffEnv)
+	if !ok {
+		return nil
+	}
+	os.Unsetenv(HandoffEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil || fd < 3 {
+		return fmt.Errorf("nserv: %s: invalid file descriptor %q", HandoffEnv, v)
+	}
+	f := os.NewFile(uintptr(fd), "handoff")
+	defer f.Close()
+	return srv.readHandoff(f)
+}
+
+// readHandoff restores the runtime settings read from r.
+func (srv *Server) readHandoff(r io.Reader) error {
+	var state handoffState
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return fmt.Errorf("nserv: %s: %v", HandoffEnv, err)
+	}
+	srv.bans.restore(state.Bans)
+	if err := srv.tickets.restore(state.TicketKeys); err != nil {
+		return err
+	}
+	if state.Maintenance != nil {
+		return srv.SetMaintenance(state.Maintenance)
+	}
+	return nil
+}
+
 // CopyListenerFD returns DUP of the file descriptor associated with the listener.
 // If the server isn't running the behavior is as in Server.OperateOnListener.
 func (srv *Server) CopyListenerFD() (fd *os.File, err error) {
-	srv.OperateOnListener(func(l limitnet.ThrottledListener) error {
+	err = srv.OperateOnListener(func(l limitnet.ThrottledListener) (err error) {
 		fd, err = limitnet.CopyFD(l)
-		return err
+		return
 	})
 	return
 }
 
 // OperateOnListener applies function fun to the server's listener. It ensures
-// the server is running during execution of fun (returns an error if stopped or
-// hangs if it hasn't been started).
+// the server is running during execution of fun (returns ErrServerNotRunning if
+// the server isn't in StateServing). Function fun mustn't call methods changing
+// the server's state (Stop, MaxConns, etc.).
 func (srv *Server) OperateOnListener(fun func(limitnet.ThrottledListener) error) error {
-	srv.initialize()
-	// take the listener
-	l, ok := <-srv.tlist
-	if !ok {
-		return errors.New("Server not running.")
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.State() != StateServing {
+		return ErrServerNotRunning
 	}
-	defer func() {
-		//replace the listener
-		srv.tlist <- l
-	}()
-	return fun(l)
+	return fun(srv.listener)
 }
@@ -1,11 +1,98 @@
 package nserv_test
 
 import (
+	"context"
+	"encoding/json"
 	"gopkg.in/kornel661/nserv.v0"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
+// successorEnv tells the test binary re-executed by ZeroDowntimeRestart to
+// serve as the successor (see TestSuccessor): "http", or "https" followed by
+// the certificate and key files (separated by os.PathListSeparator).
+const successorEnv = "NSERV_TEST_SUCCESSOR"
+
+func TestMain(m *testing.M) {
+	nserv.InitializeZeroDowntime()
+	os.Exit(m.Run())
+}
+
+// successorState is the state of the successor reported at /state.
+type successorState struct {
+	Bans    []nserv.Ban
+	Handoff bool // HandoffEnv left in the environment
+}
+
+// TestSuccessor serves in the successor process of the handoff tests (see
+// handOff), it's skipped otherwise. Besides handler, the successor reports its
+// state at /state and stops at /stop.
+func TestSuccessor(t *testing.T) {
+	mode := filepath.SplitList(os.Getenv(successorEnv))
+	if len(mode) == 0 || !nserv.CanResume() {
+		t.Skip("not a successor")
+	}
+	srv := newServer()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handler)
+	mux.HandleFunc("/state", func(w http.ResponseWriter, r *http.Request) {
+		_, handoff := os.LookupEnv(nserv.HandoffEnv)
+		json.NewEncoder(w).Encode(&successorState{Bans: srv.Bans(), Handoff: handoff})
+	})
+	mux.HandleFunc("/stop", func(w http.ResponseWriter, r *http.Request) {
+		go srv.Stop()
+	})
+	srv.Handler = mux
+	var err error
+	if len(mode) == 3 && mode[0] == "https" {
+		srv.SessionTickets = &nserv.SessionTicketPolicy{Rotation: time.Hour}
+		err = srv.ResumeAndServeTLS(mode[1], mode[2])
+	} else {
+		err = srv.ResumeAndServe()
+	}
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// handOff restarts srv (served till finish is closed) with zero downtime, the
+// successor is this test binary running TestSuccessor in mode (see
+// successorEnv).
+func handOff(t *testing.T, srv *nserv.Server, finish chan struct{}, mode ...string) {
+	t.Setenv(successorEnv, strings.Join(mode, string(os.PathListSeparator)))
+	if err := srv.ZeroDowntimeRestart("-test.run=^TestSuccessor$"); err != nil {
+		t.Fatal(err)
+	}
+	<-finish
+	if s := srv.State(); s != nserv.StateHandedOff {
+		t.Errorf("Server in state %v after handoff.", s)
+	}
+}
+
+// stopSuccessor stops the successor (requesting scheme://addr/stop with
+// client, which mustn't keep connections alive) and waits till it stops
+// listening.
+func stopSuccessor(t *testing.T, client *http.Client, scheme string) {
+	if resp, err := client.Get(scheme + "://" + addr + "/stop"); err != nil {
+		t.Error(err)
+	} else {
+		resp.Body.Close()
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(delay) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		c.Close()
+	}
+	t.Error("The successor still listening.")
+}
+
 func TestCanResume(t *testing.T) {
 	srv := newServer()
 	go func() {
@@ -36,6 +123,10 @@ func TestCopyListenerFD(t *testing.T) {
 			}
 
 		}()
+		if err := srv.WaitForState(context.Background(), nserv.StateServing); err != nil {
+			t.Errorf("srv.WaitForState error: %v", err)
+			return
+		}
 		fd, err := srv.CopyListenerFD()
 		if err != nil {
 			t.Errorf("srv.CopyListenerFD error: %v", err)